@@ -3,6 +3,11 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/docopt/docopt-go"
@@ -13,18 +18,173 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
+	"unsafe"
 )
 
 //RandomNonce is the (hopefully) unique indentifier of a particular instance of pmjq
 var RandomNonce = fmt.Sprintf("%v", rand.Int())
 
+//stagingPrefix starts the name of the hidden files in which the outputs
+//are written before being renamed to their final name. As lock files,
+//they are never considered as inputs
+const stagingPrefix = ".pmjq-"
+
+//attemptsPrefix starts the name of the hidden files in which the number of
+//failed attempts at processing an input is kept, next to it. As staging
+//files, they are never considered as inputs
+const attemptsPrefix = stagingPrefix + "attempts-"
+
+//archivedPrefix starts the name of the hidden marker pmjq writes next to each
+//file it archives when --done-retention is given, so that it only ever
+//prunes the files it archived itself
+const archivedPrefix = stagingPrefix + "archived-"
+
+//maxRetryDelay caps the delay between two attempts, whatever --retry-delay
+const maxRetryDelay = time.Hour
+
+//killGrace is how long the processes of a job are given to exit after a
+//SIGTERM, before they are sent a SIGKILL
+const killGrace = 5 * time.Second
+
+//These are from prctl(2) and capget(2)
+const (
+	prCapbsetDrop           = 24
+	prSetChildSubreaper     = 36
+	prSetNoNewPrivs         = 38
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+//jobs keeps track of the process groups of the running jobs, so that they can
+//be signaled from outside of their worker, when pmjq stops or when a lock
+//is lost
+var jobs = struct {
+	sync.Mutex
+	groups   map[*Transition]int
+	lost     map[*Transition]bool
+	stopping bool
+	running  sync.WaitGroup
+}{groups: make(map[*Transition]int), lost: make(map[*Transition]bool)}
+
+//children are the processes pmjq started and waits for itself, by pid, with
+//their start time as pids are reused, so that reapOrphans leaves them alone
+var children = struct {
+	sync.Mutex
+	started map[int]string
+}{started: make(map[int]string)}
+
+//logLevel is the severity of a log message
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+//levelNames are the words by which the levels are known, in the logs and on
+//the command line
+var levelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+//minLevel is the level of the least severe messages that are logged
+var minLevel = levelDebug
+
+//jsonLogs tells whether to log JSON lines instead of text
+var jsonLogs = false
+
+//logEntry is a log message, as logged in JSON
+type logEntry struct {
+	Time      string   `json:"time"`
+	Level     string   `json:"level"`
+	File      string   `json:"file,omitempty"`
+	ID        int      `json:"id"`
+	Job       string   `json:"job,omitempty"`
+	Custodian string   `json:"custodian,omitempty"`
+	Worker    int      `json:"worker"`
+	Inputs    []string `json:"inputs,omitempty"`
+	Outputs   []string `json:"outputs,omitempty"`
+	Log       string   `json:"log,omitempty"`
+	Pid       int      `json:"pid,omitempty"`
+	Msg       string   `json:"msg"`
+}
+
+//logf logs the message about t (which may be nil) at the given level.
+//The text format is the transition (see String()), the level, then the
+//message, which is what lnav_pmjq.json and pmjq_sff expect
+func logf(t *Transition, level logLevel, format string, args ...interface{}) {
+	if level < minLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLogs {
+		if t == nil {
+			log.Output(2, fmt.Sprintf("%v %v", level, msg))
+		} else {
+			log.Output(2, fmt.Sprintf("%v %v %v", t, level, msg))
+		}
+		return
+	}
+	entry := logEntry{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Level: level.String(),
+		Msg:   strings.TrimSpace(msg),
+	}
+	if _, file, line, ok := runtime.Caller(1); ok {
+		entry.File = fmt.Sprintf("%v:%v", filepath.Base(file), line)
+	}
+	if t != nil {
+		entry.ID = t.id
+		entry.Job = t.JobID()
+		entry.Custodian = t.custodian
+		entry.Worker = t.workerID
+		entry.Inputs = t.inputPaths
+		entry.Outputs = t.outputPaths
+		entry.Log = t.logPath
+		if t.cmd != nil && t.cmd.Process != nil {
+			entry.Pid = t.cmd.Process.Pid
+		}
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"level":"ERROR","msg":%q}`, err.Error()))
+	}
+	log.Output(2, string(b))
+}
+
+//These are the policies regarding outputs that already exist
+const (
+	existingOverwrite = "overwrite"
+	existingSkip      = "skip"
+	existingError     = "error"
+	existingSuffix    = "suffix"
+	existingVersion   = "version"
+)
+
+//stagingPath returns the path of the hidden file in which the output that
+//will end up at the given path is written
+func stagingPath(name string) string {
+	dir, file := filepath.Split(name)
+	return path.Join(dir, fmt.Sprintf("%v%v-%v", stagingPrefix, RandomNonce, file))
+}
+
 //lockFileTouch changes the content of the file to avoid it being
 //detected as stale
 func lockFileTouch(name string) error {
@@ -52,7 +212,7 @@ func lockFileRemoveIfStale(name string) {
 		return
 	}
 	if bytes.Compare(b, bb) == 0 {
-		log.Println("WARNING: Removing stale lock file " + name)
+		logf(nil, levelWarning, "Removing stale lock file %v", name)
 		os.Remove(name)
 	}
 }
@@ -88,7 +248,7 @@ func lockFileCreate(name string) error {
 		//Try to create it
 		return lockFileActuallyCreate(name)
 	} else if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	//If it exists
 	//Check for staleness and return an error
@@ -141,13 +301,12 @@ func (dt *DirTemplate) String() string {
 
 //ExecWithTransition returns the path of the receiver when exectued
 // whithin the given transition
-func (dt *DirTemplate) ExecWithTransition(t *Transition) string {
-	var b bytes.Buffer
-	err := dt.template.Execute(&b, t)
+func (dt *DirTemplate) ExecWithTransition(t *Transition) (string, error) {
+	expansion, err := t.execute(&dt.template)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	return path.Join(dt.dir, b.String())
+	return path.Join(dt.dir, expansion), nil
 }
 
 //FixedWidthString returns a fixed-width string representation of x,
@@ -215,6 +374,14 @@ type Transition struct {
 	//inputFiles is the list of filenames to be processed
 	inputFiles []string
 
+	//stdinInputs lists the indices of the inputs that are fed, in this order,
+	//to the command's stdin
+	stdinInputs []int
+
+	//stdinFramed is true when each input fed to stdin is preceded by its
+	//size, so that the command can tell them apart
+	stdinFramed bool
+
 	//inputPaths is the list of paths (dir + name) to be processed
 	//those paths are considered as understandable by the command that
 	//will be launched.
@@ -224,6 +391,10 @@ type Transition struct {
 	//the user to specify environment variables
 	inputPaths []string
 
+	//inputs describes the input files as they were when the job was listed,
+	//so that the templates expanded once they have been moved still see them
+	inputs []InputFile
+
 	//invariantTemplate is what will be expanded to make the Invariant
 	//after the input file names are matched
 	invariantTemplate string
@@ -242,6 +413,44 @@ type Transition struct {
 	//outputPaths is the list of paths in which some output may be written
 	outputPaths []string
 
+	//stagingPaths is the list of paths in which the outputs are actually
+	//written, before being renamed to their outputPaths counterpart
+	//once the command has succeeded
+	stagingPaths []string
+
+	//requireNonEmpty is true when an empty output makes the job fail
+	requireNonEmpty bool
+
+	//requireOutputs is true when a missing output makes the job fail
+	requireOutputs bool
+
+	//minSizeRatio is the minimal ratio between the total size of the outputs
+	//and the total size of the inputs under which the job fails
+	minSizeRatio float64
+
+	//validatorTemplate is the template to be expanded to get the command
+	//that checks the outputs. The job fails if it exits with a non zero status
+	validatorTemplate *template.Template
+
+	//exitOutcomes maps the exit codes of the command to the outcome of the job
+	//(see outcome())
+	exitOutcomes map[int]string
+
+	//signalOutcomes maps the signals that may kill the command to the outcome
+	//of the job
+	signalOutcomes map[syscall.Signal]string
+
+	//retries is the number of times a failed job is tried again before its
+	//inputs are moved to the error paths
+	retries int
+
+	//retryDelay is the delay before the first retry of a failed job. It
+	//doubles with every failed attempt
+	retryDelay time.Duration
+
+	//attempt is the number of the current attempt at processing the inputs
+	attempt int
+
 	//errors are the (directory, template) couple(s) in which an instance
 	//of the command will copy error-generating files
 	errorTemplates []*DirTemplate
@@ -250,6 +459,21 @@ type Transition struct {
 	//in case of an error
 	errorPaths []string
 
+	//doneTemplates are the (directory, template) couple(s) in which the inputs
+	//are archived once processed. They are removed if there are none
+	doneTemplates []*DirTemplate
+
+	//donePaths is the list of paths in which the inputs are archived
+	donePaths []string
+
+	//doneLink is true when the inputs are archived by hard linking them
+	//then removing them, instead of renaming them
+	doneLink bool
+
+	//doneRetention is how long the archived inputs are kept. They are kept
+	//forever if it is zero
+	doneRetention time.Duration
+
 	//logTemplate is the (directory, template) in which an instance of the
 	//command will dump its stderr
 	logTemplate *DirTemplate
@@ -257,18 +481,62 @@ type Transition struct {
 	//logPath is the path of the file in which we dump stderr
 	logPath string
 
+	//stdoutTemplate is the (directory, template) in which an instance of the
+	//command will dump its stdout, whatever the number of outputs
+	stdoutTemplate *DirTemplate
+
+	//stdoutPath is the path of the file in which we dump stdout
+	stdoutPath string
+
+	//scratchRoot is the directory in which a private scratch directory
+	//is created for each instance of the command. No scratch directory is
+	//created if it is empty
+	scratchRoot string
+
+	//Scratch is the private scratch directory of this instance of the command
+	Scratch string
+
 	//lock_release is a channel on which writing will trigger the release of one
 	//locked input or output file (at random depending on the scheduler)
 	//to release all locked files, write to it as many times as there are
 	//files in the inputs and outputs lists together
 	lockRelease chan int
 
+	//lockHolders is done once all the lockFile goroutines of the job have
+	//exited, and thus removed their lock
+	lockHolders *sync.WaitGroup
+
+	//isProbe is true for the fake job whose templates are expanded to check
+	//them, and whose files do not exist
+	isProbe bool
+
 	//workerID is the id number of the worker that will launch the actual command
 	workerID int
 
 	//The template to be expanded to get the command to run
 	cmdTemplate *template.Template
 
+	//preRunTemplate is the template to be expanded to get the hook that is
+	//run before the command. If it fails, the job is not run
+	preRunTemplate *template.Template
+
+	//onSuccessTemplate is the template to be expanded to get the hook that is
+	//run once the outputs of a successful job have been published
+	onSuccessTemplate *template.Template
+
+	//onFailureTemplate is the template to be expanded to get the hook that is
+	//run once the inputs of a failed job have been moved to the error paths
+	onFailureTemplate *template.Template
+
+	//hookTimeout is how long the hooks and the validator may run before
+	//they are killed
+	hookTimeout time.Duration
+
+	//shell is true when the expanded command is to be run by /bin/sh -c
+	//instead of being split by shellwords. The input and output paths are
+	//then given to the shell as positional parameters
+	shell bool
+
 	//cmd is the Cmd structure that controls the actual execution
 	cmd *exec.Cmd
 
@@ -289,14 +557,70 @@ type Transition struct {
 
 	//logFd is the output file fd that should be created from the process' stderr
 	logFd io.WriteCloser
+
+	//reportTemplate is the (directory, template) in which a JSON report is
+	//written when the job fails
+	reportTemplate *DirTemplate
+
+	//reportTail is the number of bytes of the end of stderr that are
+	//included in the report
+	reportTail int
+
+	//stderrTail keeps the end of the process' stderr, for the report
+	stderrTail *stderrTail
+
+	//start is when the worker started to work on the job
+	start time.Time
+
+	//credential is the user and groups the commands are run as, nil to
+	//run them as pmjq's own
+	credential *syscall.Credential
+
+	//umask is the umask of pmjq and thus of its commands, -1 to keep the
+	//inherited one
+	umask int
+
+	//sandbox tells whether to run the command in a sandbox (see sandboxCommand)
+	sandbox bool
+
+	//sandboxNet tells whether to let the command in the sandbox use the network
+	sandboxNet bool
+
+	//decompress is the codec with which the inputs fed to stdin are
+	//decompressed, nil for none. autoDecompress tells to pick it for each
+	//input from its first bytes instead
+	decompress     codec
+	autoDecompress bool
+
+	//compress is the codec with which the captured stdout is compressed,
+	//nil for none
+	compress codec
+
+	//teeOutputs are the indices of the outputs that all get the command's
+	//stdout, which is captured in the first one
+	teeOutputs []int
+
+	//onExisting is what to do when outputs already exist (see checkExisting)
+	onExisting string
+
+	//existing tells which outputs existed before the job, and must thus
+	//survive its failure
+	existing []bool
+
+	//dirMode is the permissions of the directories pmjq creates to hold
+	//the files it writes
+	dirMode os.FileMode
 }
 
+//lastID is the ID of the last transition made by Sapling
+var lastID int64
+
 //Sapling duplicates a seed transition,
-// return the copy and increase the seed's ID so that
-// no two duplicate share the same ID
+// return the copy with a new ID so that
+// no two transitions share the same ID, whatever they are duplicated from
 func (t *Transition) Sapling() Transition {
 	answer := *t
-	t.id++
+	answer.id = int(atomic.AddInt64(&lastID, 1))
 	return answer
 }
 
@@ -336,7 +660,7 @@ func (t *Transition) String() string {
 	} else if t.logTemplate != nil {
 		log = FixedWidthString(fmt.Sprintf("%v", t.logTemplate))
 	}
-	if t.cmd != nil {
+	if t.cmd != nil && t.cmd.Process != nil {
 		pid = fmt.Sprintf("%v", t.cmd.Process.Pid)
 	}
 	release := "free"
@@ -356,6 +680,181 @@ func (t *Transition) Input(i int) string {
 	return t.inputFiles[i]
 }
 
+//Output returns the path in which the command should write its ith output
+//It is not the final path of the output, but a hidden file in the same
+//directory, that will be renamed if the command succeeds
+func (t *Transition) Output(i int) string {
+	return t.stagingPaths[i]
+}
+
+//InputPath returns the path of the ith input file
+func (t *Transition) InputPath(i int) string {
+	return t.inputPaths[i]
+}
+
+//OutputPath returns the final path of the ith output, the one it is renamed
+//to if the command succeeds
+func (t *Transition) OutputPath(i int) string {
+	return t.outputPaths[i]
+}
+
+//Outputs returns the final paths of all the outputs
+func (t *Transition) Outputs() []string {
+	return t.outputPaths
+}
+
+//LogPath returns the path of the file in which the command's stderr is
+//written, if any
+func (t *Transition) LogPath() string {
+	return t.logPath
+}
+
+//Worker returns the id number of the worker running the job
+func (t *Transition) Worker() int {
+	return t.workerID
+}
+
+//Attempt returns the number of the current attempt at processing the inputs,
+//starting at 1
+func (t *Transition) Attempt() int {
+	return t.attempt
+}
+
+//InputFile describes an input of the job, for use in templates
+type InputFile struct {
+	Name  string      //Name of the file
+	Path  string      //Path of the file
+	Dir   string      //Directory of the --input pattern the file matched
+	Size  int64       //Size in bytes
+	Mtime time.Time   //Modification date
+	Mode  os.FileMode //Permissions and mode bits
+}
+
+//Inputs returns the description of all the inputs, in the order of the
+//--input patterns
+func (t *Transition) Inputs() []InputFile {
+	return append([]InputFile(nil), t.inputs...)
+}
+
+//statInputs fills the description of the inputs of a candidate
+func (t *Transition) statInputs() error {
+	t.inputs = make([]InputFile, len(t.inputPaths))
+	for i, p := range t.inputPaths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		t.inputs[i] = InputFile{t.inputFiles[i], p, t.inputPatterns[i].dir,
+			fi.Size(), fi.ModTime(), fi.Mode()}
+	}
+	return nil
+}
+
+//templateFuncs are the functions available in every template. Those that
+//transform a string take it last, so that they can be used in a pipeline:
+//{{.Input 0 | stripext | upper}}
+var templateFuncs = template.FuncMap{
+	"basename": filepath.Base,
+	"dirname":  filepath.Dir,
+	"ext":      filepath.Ext,
+	"stripext": func(p string) string { return strings.TrimSuffix(p, filepath.Ext(p)) },
+	"replace":  func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"regexReplace": func(re, repl, s string) (string, error) {
+		r, err := regexp.Compile(re)
+		if err != nil {
+			return "", err
+		}
+		return r.ReplaceAllString(s, repl), nil
+	},
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"date":     func(layout string) string { return time.Now().Format(layout) },
+	"mtime":    mtime(false),
+	"hostname": os.Hostname,
+	"uuid":     newUUID,
+	"ulid":     newULID,
+	"sha256": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"env":        os.Getenv,
+	"shellquote": func(s string) string { return shellwordsJoin([]string{s}) },
+}
+
+//mtime returns the mtime template function, that formats the modification
+//date of a file. For a probe, whose files do not exist, missing files are
+//given the zero date
+func mtime(probe bool) func(layout, name string) (string, error) {
+	return func(layout, name string) (string, error) {
+		fi, err := os.Stat(name)
+		if probe && os.IsNotExist(err) {
+			return time.Time{}.Format(layout), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return fi.ModTime().Format(layout), nil
+	}
+}
+
+//execute expands the given template with the data of the job
+func (t *Transition) execute(tmplt *template.Template) (string, error) {
+	if t.isProbe {
+		clone, err := tmplt.Clone()
+		if err != nil {
+			return "", err
+		}
+		tmplt = clone.Funcs(template.FuncMap{"mtime": mtime(true)})
+	}
+	var b bytes.Buffer
+	err := tmplt.Execute(&b, t)
+	return b.String(), err
+}
+
+//newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+//newULID returns a ULID: a 48 bits timestamp in milliseconds followed by 80
+//random bits, written in Crockford's base32, so that they sort by date
+func newULID() (string, error) {
+	const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	b := make([]byte, 16)
+	if _, err := crand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	//26 characters of 5 bits make 130 bits, the 2 extra ones are the
+	//leading zeros of the first character
+	answer := make([]byte, 26)
+	var acc uint32
+	var bits uint
+	j := 25
+	for i := 15; i >= 0; i-- {
+		acc |= uint32(b[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			answer[j] = alphabet[acc&31]
+			acc >>= 5
+			bits -= 5
+			j--
+		}
+	}
+	answer[j] = alphabet[acc&31]
+	return string(answer), nil
+}
+
 //minInt return the minimum value among all its int arguments
 func minInt(li ...int) int {
 	m := li[0]
@@ -381,17 +880,32 @@ func candidateInputs(seed *Transition, quitEmpty bool) chan *Transition {
 	for i := range seed.inputPatterns {
 		entries, err := ioutil.ReadDir(seed.inputPatterns[i].dir)
 		if err != nil {
-			log.Fatal(err)
+			//Maybe a network filesystem hiccup, we'll try again next time
+			logf(seed, levelError, "Could not list input dir: %v", err)
+			transitions := make(chan *Transition)
+			close(transitions)
+			return transitions
 		}
 		lle[i] = make([]string, 0, len(entries))
 		for _, entry := range entries {
 			if strings.HasSuffix(entry.Name(), ".lock") { //Lockfiles are not to be processed
 				continue
 			}
+			if strings.HasPrefix(entry.Name(), stagingPrefix) { //Neither are outputs being written, attempts counters, etc.
+				continue
+			}
 			if !seed.inputPatterns[i].pattern.MatchString(entry.Name()) {
 				//We only add files that abide by the pattern
 				continue
 			}
+			if quitEmpty {
+				//Failed inputs left in place after their last attempt
+				//would keep us waiting forever
+				n, _ := seed.readAttemptsOf(path.Join(seed.inputPatterns[i].dir, entry.Name()))
+				if n > seed.retries {
+					continue
+				}
+			}
 			lle[i] = append(lle[i], entry.Name())
 		}
 		if cardinal == 0 {
@@ -402,11 +916,11 @@ func candidateInputs(seed *Transition, quitEmpty bool) chan *Transition {
 		waiting[i] = len(lle[i])
 	}
 	if quitEmpty && cardinal == 0 {
-		log.Println("Nothing left to do, exiting")
+		logf(seed, levelInfo, "Nothing left to do, exiting")
 		os.Exit(0)
 	}
 	mi := minInt(waiting...)
-	log.Printf("%v INFO Candidates for %v:%v", seed, strings.Join(inputs, ":"), mi)
+	logf(seed, levelInfo, "Candidates for %v:%v", strings.Join(inputs, ":"), mi)
 	//log.Println("DBG: lle")
 	//log.Println(lle)
 	//http://stackoverflow.com/questions/29002724/implement-ruby-style-cartesian-product-in-go
@@ -454,7 +968,7 @@ func candidateInputs(seed *Transition, quitEmpty bool) chan *Transition {
 					}
 				}
 			}
-			log.Printf("%v DEBUG Candidate input", &t)
+			logf(&t, levelDebug, "Candidate input")
 			transitions <- &t
 		}
 		close(transitions)
@@ -482,27 +996,257 @@ func dirLister(seed *Transition, toLocker chan<- *Transition, quitEmpty bool) {
 		transitions := candidateInputs(&t, quitEmpty)
 		for t := range transitions {
 			t.custodian = "dirLister"
-			t.outputPaths = make([]string, len(t.outputTemplates))
-			for i := range t.outputTemplates {
-				log.Printf("%v DEBUG i is %v, out of %v and %v\n", t, i, len(t.outputTemplates), len(t.outputPaths))
-				t.outputPaths[i] = t.outputTemplates[i].ExecWithTransition(t)
+			//Checked again once the files are locked, as another
+			//instance of pmjq may have tried in the meantime
+			if !t.due() {
+				logf(t, levelDebug, "Attempt %v is not due yet", t.attempt)
+				continue
 			}
-			log.Printf("%v DEBUG Output template expanded, sending to locker\n", t)
+			if err := t.expandOutputs(); err != nil {
+				logf(t, levelError, "%v", err)
+				continue
+			}
+			logf(t, levelDebug, "Output template expanded, sending to locker\n")
 			//Feed each element to the blocking channel
 			toLocker <- t
 		}
 	}
 }
 
+//expandOutputs describes the inputs of a candidate, then computes its output
+//paths and the staging paths the command actually writes to
+func (t *Transition) expandOutputs() error {
+	if err := t.statInputs(); err != nil {
+		return err
+	}
+	t.outputPaths = make([]string, len(t.outputTemplates))
+	t.stagingPaths = make([]string, len(t.outputTemplates))
+	for i := range t.outputTemplates {
+		logf(t, levelDebug, "i is %v, out of %v and %v\n", i, len(t.outputTemplates), len(t.outputPaths))
+		var err error
+		t.outputPaths[i], err = t.outputTemplates[i].ExecWithTransition(t)
+		if err != nil {
+			return fmt.Errorf("Could not expand output template %v: %v", t.outputTemplates[i], err)
+		}
+		t.stagingPaths[i] = stagingPath(t.outputPaths[i])
+	}
+	return nil
+}
+
+//plannedJob is what a dry run tells about a job pmjq would run
+type plannedJob struct {
+	ID           string            `json:"id"`
+	Inputs       []string          `json:"inputs"`
+	Invariant    string            `json:"invariant"`
+	NamedMatches map[string]string `json:"named_matches"`
+	Attempt      int               `json:"attempt"`
+	Due          bool              `json:"due"`
+	Command      []string          `json:"command"`
+	Outputs      []string          `json:"outputs"`
+	Stdout       string            `json:"stdout,omitempty"`
+	Errors       []string          `json:"errors,omitempty"`
+	Log          string            `json:"log,omitempty"`
+	Done         []string          `json:"done,omitempty"`
+	Report       string            `json:"report,omitempty"`
+	Problem      string            `json:"problem,omitempty"`
+}
+
+//plan expands every template of a candidate as the worker would, without
+//touching anything
+func (t *Transition) plan() plannedJob {
+	job := plannedJob{
+		ID:           fmt.Sprintf("%06v", t.id),
+		Inputs:       t.inputPaths,
+		Invariant:    t.Invariant,
+		NamedMatches: make(map[string]string),
+	}
+	for name, value := range t.NamedMatches {
+		if name != "" { //Unnamed subgroups
+			job.NamedMatches[name] = value
+		}
+	}
+	job.Due = t.due()
+	job.Attempt = t.attempt
+	if t.scratchRoot != "" {
+		t.Scratch = path.Join(t.scratchRoot, fmt.Sprintf("pmjq-%06v-XXXXXX", t.id))
+	}
+	expand := func(dts []*DirTemplate) []string {
+		var paths []string
+		for _, dt := range dts {
+			if job.Problem != "" {
+				return paths
+			}
+			p, err := dt.ExecWithTransition(t)
+			if err != nil {
+				job.Problem = fmt.Sprintf("Could not expand template %v: %v", dt, err)
+			}
+			paths = append(paths, p)
+		}
+		return paths
+	}
+	//expandOne expands a single template, to an empty path if a previous one
+	//could not be expanded
+	expandOne := func(dt *DirTemplate) string {
+		if paths := expand([]*DirTemplate{dt}); len(paths) > 0 {
+			return paths[0]
+		}
+		return ""
+	}
+	if err := t.expandOutputs(); err != nil {
+		job.Problem = err.Error()
+		return job
+	}
+	job.Outputs = t.outputPaths
+	if t.stdoutTemplate != nil {
+		job.Stdout = expandOne(t.stdoutTemplate)
+	}
+	job.Errors = expand(t.errorTemplates)
+	if t.logTemplate != nil {
+		job.Log = expandOne(t.logTemplate)
+		if job.Log != "" && t.attempt > 1 {
+			job.Log = fmt.Sprintf("%v.%v", job.Log, t.attempt)
+		}
+	}
+	job.Done = expand(t.doneTemplates)
+	if t.reportTemplate != nil {
+		job.Report = expandOne(t.reportTemplate)
+	}
+	if job.Problem != "" {
+		return job
+	}
+	argv, err := t.expandCommand()
+	if err != nil {
+		job.Problem = err.Error()
+	}
+	job.Command = argv
+	return job
+}
+
+//dryRun lists the jobs pmjq would run right now, and the conflicts between
+//them, in the given format (text or json). It returns the exit status: 0 if
+//all is well, 1 otherwise
+func dryRun(seed *Transition, format string) int {
+	candidates := seed.Sapling()
+	var jobs []plannedJob
+	for t := range candidateInputs(&candidates, false) {
+		jobs = append(jobs, t.plan())
+	}
+	//Jobs writing the same file, or consuming the same input
+	written := make(map[string][]string)
+	read := make(map[string][]string)
+	for _, job := range jobs {
+		paths := append(append(append([]string{}, job.Outputs...), job.Errors...), job.Done...)
+		for _, p := range []string{job.Stdout, job.Log, job.Report} {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+		for _, p := range paths {
+			written[p] = append(written[p], job.ID)
+		}
+		for _, p := range job.Inputs {
+			read[p] = append(read[p], job.ID)
+		}
+	}
+	conflicts := []string{}
+	for _, c := range []struct {
+		verb  string
+		paths map[string][]string
+	}{{"written", written}, {"consumed", read}} {
+		for p, ids := range c.paths {
+			if len(ids) > 1 {
+				conflicts = append(conflicts, fmt.Sprintf("%v would be %v by jobs %v", p, c.verb, strings.Join(ids, ", ")))
+			}
+		}
+	}
+	sort.Strings(conflicts)
+	status := 0
+	if len(conflicts) > 0 {
+		status = 1
+	}
+	for _, job := range jobs {
+		if job.Problem != "" {
+			status = 1
+		}
+	}
+	if format == "json" {
+		if jobs == nil {
+			jobs = []plannedJob{}
+		}
+		b, err := json.MarshalIndent(struct {
+			Jobs      []plannedJob `json:"jobs"`
+			Conflicts []string     `json:"conflicts"`
+		}{jobs, conflicts}, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+		return status
+	}
+	for _, job := range jobs {
+		fmt.Printf("Job %v", job.ID)
+		if !job.Due {
+			fmt.Printf(" (attempt %v, not due yet)", job.Attempt)
+		} else if job.Attempt > 1 {
+			fmt.Printf(" (attempt %v)", job.Attempt)
+		}
+		fmt.Println()
+		fmt.Printf("  inputs:    %v\n", strings.Join(job.Inputs, " "))
+		if job.Invariant != "" {
+			fmt.Printf("  invariant: %v\n", job.Invariant)
+		}
+		names := make([]string, 0, len(job.NamedMatches))
+		for name := range job.NamedMatches {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  match:     %v=%v\n", name, job.NamedMatches[name])
+		}
+		if job.Problem != "" {
+			fmt.Printf("  PROBLEM:   %v\n", job.Problem)
+			continue
+		}
+		fmt.Printf("  command:   %v\n", shellwordsJoin(job.Command))
+		fmt.Printf("  outputs:   %v\n", strings.Join(job.Outputs, " "))
+		for _, line := range []struct {
+			name  string
+			paths []string
+		}{{"stdout", []string{job.Stdout}}, {"errors", job.Errors}, {"log", []string{job.Log}},
+			{"done", job.Done}, {"report", []string{job.Report}}} {
+			if joined := strings.TrimSpace(strings.Join(line.paths, " ")); joined != "" {
+				fmt.Printf("  %-10v %v\n", line.name+":", joined)
+			}
+		}
+	}
+	for _, conflict := range conflicts {
+		fmt.Printf("CONFLICT %v\n", conflict)
+	}
+	return status
+}
+
+//shellwordsJoin quotes argv for display, so that it can be pasted in a shell
+func shellwordsJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
 //This function is the abort function for the locker, when something went
 //during lock acquisition
 func lockAbort(t *Transition, waitingToken int, lockerSpawnerSynchro chan int) {
 	t.custodian = "lockAbort"
 	for i := 0; i < len(t.inputPaths)+len(t.outputPaths); i++ {
-		log.Printf("%v DEBUG Releasing partial lock %v\n", t, i)
+		logf(t, levelDebug, "Releasing partial lock %v\n", i)
 		t.lockRelease <- 1
 	}
-	log.Printf("%v DEBUG Giving waiting token %v back to spawner", t, waitingToken)
+	logf(t, levelDebug, "Giving waiting token %v back to spawner", waitingToken)
 	lockerSpawnerSynchro <- waitingToken
 }
 
@@ -523,20 +1267,22 @@ func locker(fromDirLister <-chan *Transition, lockerSpawnerSynchro chan int,
 		//log.Println("locker: Waiting on dirLister to suggest files to try to lock:")
 		t := <-fromDirLister
 		t.custodian = "locker"
-		log.Printf("%v DEBUG Received from dirLister", t)
+		logf(t, levelDebug, "Received from dirLister")
 		success := make(chan int)
 		t.lockRelease = make(chan int)
 		nbFiles := len(t.inputPaths) + len(t.outputPaths)
-		log.Printf("%v DEBUG waiting on spawner", t)
+		t.lockHolders = new(sync.WaitGroup)
+		t.lockHolders.Add(nbFiles)
+		logf(t, levelDebug, "waiting on spawner")
 		waitingToken := <-lockerSpawnerSynchro //Will unblock once spawner is ready to spawn
-		log.Printf("%v DEBUG Got waiting token %v from spawner", t, waitingToken)
+		logf(t, levelDebug, "Got waiting token %v from spawner", waitingToken)
 		for i := 0; i < nbFiles; i++ {
 			go lockFile(t, i, success, t.lockRelease)
 		}
 		status := 0
 		for i := 0; i < nbFiles; i++ {
 			status += <-success
-			log.Printf("%v DEBUG After iteration %v, status is %v", t, i, status)
+			logf(t, levelDebug, "After iteration %v, status is %v", i, status)
 		}
 		if status != 0 { //At least one lock was not acquired
 			lockAbort(t, waitingToken, lockerSpawnerSynchro)
@@ -544,9 +1290,9 @@ func locker(fromDirLister <-chan *Transition, lockerSpawnerSynchro chan int,
 		}
 		//All locks acquired
 		status = 0
-		log.Printf("%v DEBUG All locks acquired, testing existence", t)
+		logf(t, levelDebug, "All locks acquired, testing existence")
 		for _, fname := range t.inputPaths {
-			log.Printf("%v DEBUG All locks acquired, testing existence of %v", t, fname)
+			logf(t, levelDebug, "All locks acquired, testing existence of %v", fname)
 			if _, err := os.Stat(fname); os.IsNotExist(err) {
 				//If file does not exist
 				status = -1
@@ -558,7 +1304,12 @@ func locker(fromDirLister <-chan *Transition, lockerSpawnerSynchro chan int,
 			continue
 		}
 		//All files exist
-		log.Printf("%v DEBUG Sending locked files to spawner", t)
+		if !t.due() {
+			logf(t, levelDebug, "Attempt %v is not due yet", t.attempt)
+			lockAbort(t, waitingToken, lockerSpawnerSynchro)
+			continue
+		}
+		logf(t, levelDebug, "Sending locked files to spawner")
 		toSpawner <- t
 	}
 }
@@ -570,6 +1321,7 @@ func locker(fromDirLister <-chan *Transition, lockerSpawnerSynchro chan int,
 //It writes its status (0:success, !=0: failure) on the success channel.
 func lockFile(t *Transition, fileno int, success chan<- int, release <-chan int) {
 	t.custodian = "lockFile"
+	defer t.lockHolders.Done()
 	var fname string
 	if fileno < len(t.inputPaths) {
 		fname = fmt.Sprintf("%v", t.inputPaths[fileno])
@@ -577,229 +1329,1944 @@ func lockFile(t *Transition, fileno int, success chan<- int, release <-chan int)
 		fname = fmt.Sprintf("%v", t.outputPaths[fileno-len(t.inputPaths)])
 	}
 	fname += ".lock"
-	log.Printf("%v DEBUG Acquiring lock on %v", t, fname)
-	err := lockFileCreate(fname)
+	logf(t, levelDebug, "Acquiring lock on %v", fname)
+	var err error
+	if fileno >= len(t.inputPaths) {
+		err = t.makeParent(fname)
+	}
+	if err == nil {
+		err = lockFileCreate(fname)
+	}
 	if err != nil {
-		log.Printf("%v WARNING Could not get a lock on %v error %v", t, fname, err)
+		logf(t, levelWarning, "Could not get a lock on %v error %v", fname, err)
 		success <- 1
 		i := <-release
-		log.Printf("%v DEBUG %v exiting status %v", t, fname, i)
+		logf(t, levelDebug, "%v exiting status %v", fname, i)
 		return
 	}
 	success <- 0
 	defer func() {
 		err = os.Remove(fname)
-		log.Printf("%v DEBUG Deferred lock release on %v: %v", t, fname, err)
+		logf(t, levelDebug, "Deferred lock release on %v: %v", fname, err)
 	}()
 	timeChan := make(chan int)
 	go func() { timeChan <- 0 }()
 	for true {
 		select {
 		case _ = <-timeChan:
-			log.Printf("%v DEBUG Refreshing lock on %v ", t, fname)
-			lockFileTouch(fname)
+			logf(t, levelDebug, "Refreshing lock on %v ", fname)
+			if err := lockFileTouch(fname); err != nil {
+				logf(t, levelError, "Lost the lock on %v (%v), killing the job", fname, err)
+				jobs.Lock()
+				jobs.lost[t] = true
+				jobs.Unlock()
+				t.signalJob(syscall.SIGTERM)
+			}
 			go func() {
 				time.Sleep(60 * time.Second)
 				timeChan <- 0
 			}()
 		case i := <-release:
-			log.Printf("%v DEBUG %v exiting status %v", t, fname, i)
+			logf(t, levelDebug, "%v exiting status %v", fname, i)
+			return
+		}
+	}
+}
+
+//progressInterval is how often the progress of a running command is logged
+const progressInterval = 30 * time.Second
+
+//reportProgress logs, every progressInterval until done is closed, how much
+//of its stdin the command has read and how much it has written on its stdout.
+//Both are known from the position in the files, which the command shares
+//with pmjq when they are handed to it directly
+func (t *Transition) reportProgress(done <-chan struct{}) {
+	var inputs []*os.File
+	switch in := t.inputFd.(type) {
+	case *os.File:
+		inputs = []*os.File{in}
+	case *stdinStream:
+		inputs = in.files
+	}
+	output, _ := t.outputFd.(*os.File)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
 			return
+		case <-ticker.C:
+		}
+		progress := []string{fmt.Sprintf("running for %v", time.Since(t.start).Round(time.Second))}
+		if len(inputs) > 0 {
+			var read, size int64
+			for _, f := range inputs {
+				pos, _ := f.Seek(0, io.SeekCurrent)
+				read += pos
+				if info, err := f.Stat(); err == nil {
+					size += info.Size()
+				}
+			}
+			progress = append(progress, fmt.Sprintf("%v/%v bytes of stdin read", read, size))
 		}
+		if output != nil {
+			if info, err := output.Stat(); err == nil {
+				progress = append(progress, fmt.Sprintf("%v bytes of stdout written", info.Size()))
+			}
+		}
+		logf(t, levelInfo, "Progress: %v", strings.Join(progress, ", "))
 	}
 }
 
-// Read from src in buckets of 4096 and dumps them in dst
-// It logs everything in the process, appending logid before
+//goBucketDumper copies src to dst in the background, and sends the error,
+//if any, on the returned channel once it is done
 func goBucketDumper(t *Transition, srcdst string) chan error {
 	c := make(chan error)
 	var src io.ReadCloser
 	var dst io.WriteCloser
 	if srcdst == "disk->stdin" {
-		log.Printf("%v DEBUG %v, Input file is %v",
-			t, srcdst, t.inputFd)
+		logf(t, levelDebug, "%v, Input file is %v", srcdst, t.inputFd)
 		src = t.inputFd
 		dst = t.stdin
 	} else if srcdst == "stdout->disk" {
-		log.Printf("%v DEBUG %v, Input file is %v",
-			t, srcdst, t.stdout)
+		logf(t, levelDebug, "%v, Input file is %v", srcdst, t.stdout)
 		src = t.stdout
 		dst = t.outputFd
 	} else if srcdst == "stderr->disk" {
-		log.Printf("%v DEBUG %v, Input file is %v",
-			t, srcdst, t.stderr)
+		logf(t, levelDebug, "%v, Input file is %v", srcdst, t.stderr)
 		src = t.stderr
 		dst = t.logFd
 	}
 	go func() {
-		data := make([]byte, 4096)
-		for true {
-			data = data[:cap(data)]
-			n, err := src.Read(data)
-			if err != nil {
-				if err == io.EOF {
-					src.Close()
-					dst.Close()
-					c <- nil
-					break
-				} else {
-					log.Fatal(err)
-					c <- err
-					break
-				}
-			}
-			data = data[:n]
-			log.Printf("%v DEBUG %v --[%04v]->", t, srcdst, n)
-			start := 0
-			for start < n {
-				n2, err := dst.Write(data)
-				if err != nil {
-					log.Printf("%v In bucketdumper, start=%v, n=%v, n2=%v.", t, start, n, n2)
-					log.Fatal(err)
-					c <- err
-					break
-				}
-				start += n2
-			}
+		n, answer := io.Copy(dst, src)
+		logf(t, levelDebug, "%v --[%v]->", srcdst, n)
+		//Closing both ends lets the other side know we are done, whatever
+		//the reason
+		src.Close()
+		if err := dst.Close(); err != nil && answer == nil {
+			answer = err
 		}
+		c <- answer
 	}()
 	return c
 }
 
-//The actualWorkers are tasked with launching and monitoring the data processing tasks.
-//They receive their transition as an argument, and they output their id
-//on the outputChannel once they are done.
-func actualWorker(t *Transition, id int, outputChannel chan<- int) {
-	t.custodian = fmt.Sprintf("worker%v", id)
-	t.workerID = id
-	log.Printf("%v DEBUG Starting\n", t)
-	//Expand the command
-	var b bytes.Buffer
-	err := t.cmdTemplate.Execute(&b, t)
-	if err != nil {
-		log.Fatal(err)
-	}
-	cmdArgv, err := shellwords.Parse(b.String())
-	//Launch the process
-	t.cmd = exec.Command(cmdArgv[0], cmdArgv[1:]...)
-	stdin, err := t.cmd.StdinPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer stdin.Close()
-	stdout, err := t.cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+//stderrTail is a writer that keeps the last bytes written to it,
+//and passes them along to the log file, if any
+type stderrTail struct {
+	size int
+	data []byte
+	next io.WriteCloser
+}
+
+//Write keeps the end of p
+func (st *stderrTail) Write(p []byte) (int, error) {
+	st.data = append(st.data, p...)
+	if len(st.data) > st.size {
+		copy(st.data, st.data[len(st.data)-st.size:])
+		st.data = st.data[:st.size]
 	}
-	defer stdout.Close()
-	stderr, err := t.cmd.StderrPipe()
-	if err != nil {
-		log.Fatal(err)
+	if st.next != nil {
+		return st.next.Write(p)
 	}
-	defer stderr.Close()
-	err = t.cmd.Start()
-	if err != nil {
-		log.Fatal(err)
+	return len(p), nil
+}
+
+//Close closes the log file, if any
+func (st *stderrTail) Close() error {
+	if st.next != nil {
+		return st.next.Close()
 	}
-	//Wait for the data
-	t.stdin = stdin
-	t.stdout = stdout
-	t.stderr = stderr
-	log.Printf("%v DEBUG Command started \n", t)
-	//Launch a worker that reads from disk and writes to the stdin of the command
-	//Wrapping it in an anonymous func so that Close() is called as soon
-	//as we are finished with the FDs
-	// http://grokbase.com/t/gg/golang-nuts/134883hv3h/go-nuts-io-closer-and-closing-previously-closed-object
-	if err := func() error {
-		d2schan := make(chan error)
-		if len(t.inputPaths) == 1 {
-			t.inputFd, err = os.Open(t.inputPaths[0])
-			log.Printf("%v DEBUG Input file just opened %v", t, t.inputFd)
+	return nil
+}
+
+//stdinStream is the concatenation of the inputs fed to the command's stdin
+type stdinStream struct {
+	io.Reader
+	files   []*os.File
+	readers []io.ReadCloser
+}
+
+//Close closes all the input files and the decompressors reading them
+func (s *stdinStream) Close() error {
+	var answer error
+	for _, r := range s.readers {
+		if err := r.Close(); err != nil && answer == nil {
+			answer = err
+		}
+	}
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && answer == nil {
+			answer = err
+		}
+	}
+	return answer
+}
+
+//openStdin opens the inputs that are fed to the command's stdin.
+//In framed mode, each input is preceded by its size in bytes, written
+//in decimal and followed by a newline. Compressed inputs are decompressed
+//as asked by --decompress. A single unframed input that needs no
+//decompression is returned as is, so that it can be handed directly to
+//the command
+func (t *Transition) openStdin() (io.ReadCloser, error) {
+	answer := &stdinStream{}
+	readers := make([]io.Reader, 0, 2*len(t.stdinInputs))
+	for _, i := range t.stdinInputs {
+		f, err := os.Open(t.inputPaths[i])
+		if err != nil {
+			answer.Close()
+			return nil, err
+		}
+		answer.files = append(answer.files, f)
+		c := t.decompress
+		if t.autoDecompress {
+			c = sniffCodec(f)
+		}
+		if c != nil {
+			r, err := c.newReader(f)
+			if err != nil {
+				answer.Close()
+				return nil, fmt.Errorf("Could not decompress %v: %v", t.inputPaths[i], err)
+			}
+			answer.readers = append(answer.readers, r)
+			readers = append(readers, r)
+			continue
+		}
+		if t.stdinFramed {
+			info, err := f.Stat()
+			if err != nil {
+				answer.Close()
+				return nil, err
+			}
+			readers = append(readers, strings.NewReader(fmt.Sprintf("%v\n", info.Size())))
+		}
+		readers = append(readers, f)
+	}
+	if len(answer.files) == 1 && len(answer.readers) == 0 && !t.stdinFramed {
+		return answer.files[0], nil
+	}
+	answer.Reader = io.MultiReader(readers...)
+	return answer, nil
+}
+
+//codec compresses and decompresses streams. New ones are made available to
+//--compress and --decompress by adding them to codecs
+type codec interface {
+	//magic returns the first bytes of every stream compressed with the codec
+	magic() []byte
+
+	//newReader returns a reader of the decompressed content of r
+	newReader(r io.Reader) (io.ReadCloser, error)
+
+	//newWriter returns a writer that compresses what is written to it into w.
+	//Closing it flushes it, but does not close w
+	newWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+//codecs are the codecs, by name
+var codecs = map[string]codec{
+	"gzip": gzipCodec{},
+	"zstd": commandCodec{[]byte{0x28, 0xb5, 0x2f, 0xfd}, []string{"zstd", "-q", "-c"}, []string{"zstd", "-q", "-d", "-c"}},
+	"xz":   commandCodec{[]byte{0xfd, '7', 'z', 'X', 'Z', 0}, []string{"xz", "-c"}, []string{"xz", "-d", "-c"}},
+}
+
+//codecNames returns the names of the codecs, sorted
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//sniffCodec returns the codec the given file has been compressed with,
+//according to its first bytes, or nil if it does not look compressed
+func sniffCodec(f *os.File) codec {
+	head := make([]byte, 16)
+	n, _ := f.ReadAt(head, 0)
+	for _, name := range codecNames() {
+		if bytes.HasPrefix(head[:n], codecs[name].magic()) {
+			return codecs[name]
+		}
+	}
+	return nil
+}
+
+//gzipCodec is the gzip codec of the standard library
+type gzipCodec struct{}
+
+func (gzipCodec) magic() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+func (gzipCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) newWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+//commandCodec is a codec made of external programs that filter their stdin
+//to their stdout
+type commandCodec struct {
+	magicBytes     []byte
+	compressArgv   []string
+	decompressArgv []string
+}
+
+func (c commandCodec) magic() []byte {
+	return c.magicBytes
+}
+
+func (c commandCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command(c.decompressArgv[0], c.decompressArgv[1:]...)
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := startChild(cmd); err != nil {
+		return nil, err
+	}
+	return &filterReader{out, cmd, false}, nil
+}
+
+func (c commandCodec) newWriter(w io.Writer) (io.WriteCloser, error) {
+	cmd := exec.Command(c.compressArgv[0], c.compressArgv[1:]...)
+	cmd.Stdout = w
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := startChild(cmd); err != nil {
+		return nil, err
+	}
+	return &filterWriter{in, cmd, false}, nil
+}
+
+//filterReader reads the stdout of a filter, whose failure is reported
+//when its stdout is exhausted
+type filterReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	waited bool
+}
+
+func (f *filterReader) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if err == io.EOF && !f.waited {
+		f.waited = true
+		if werr := f.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%v failed: %v", f.cmd.Args, werr)
+		}
+	}
+	return n, err
+}
+
+//Close stops the filter, whether or not it is done
+func (f *filterReader) Close() error {
+	if f.waited {
+		return nil
+	}
+	f.waited = true
+	f.ReadCloser.Close()
+	f.cmd.Process.Kill()
+	f.cmd.Wait()
+	return nil
+}
+
+//filterWriter writes to the stdin of a filter
+type filterWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	waited bool
+}
+
+//Close lets the filter finish, and reports its failure
+func (f *filterWriter) Close() error {
+	if f.waited {
+		return nil
+	}
+	f.waited = true
+	f.WriteCloser.Close()
+	if err := f.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v failed: %v", f.cmd.Args, err)
+	}
+	return nil
+}
+
+//compressedFile is a file written through a compressor
+type compressedFile struct {
+	io.WriteCloser
+	file *os.File
+}
+
+//Close flushes the compressor, then closes the file
+func (c *compressedFile) Close() error {
+	err := c.WriteCloser.Close()
+	if ferr := c.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+//parseStdin returns the indices of the inputs designated by the given
+//--stdin selector, and whether they should be framed
+func parseStdin(selector string, inputPatterns []*DirPattern) ([]int, bool, error) {
+	all := make([]int, len(inputPatterns))
+	for i := range all {
+		all[i] = i
+	}
+	switch selector {
+	case "none":
+		return nil, false, nil
+	case "concat":
+		return all, false, nil
+	case "framed":
+		return all, true, nil
+	}
+	if i, err := strconv.Atoi(selector); err == nil {
+		if i < 0 || i >= len(inputPatterns) {
+			return nil, false, fmt.Errorf("--stdin=%v: there is no input number %v", selector, i)
+		}
+		return []int{i}, false, nil
+	}
+	answer := []int{}
+	for i, dp := range inputPatterns {
+		if filepath.Base(filepath.Clean(dp.dir)) == selector {
+			answer = append(answer, i)
+		}
+	}
+	if len(answer) != 1 {
+		return nil, false, fmt.Errorf("--stdin=%v: %v input dirs bear this name instead of one", selector, len(answer))
+	}
+	return answer, false, nil
+}
+
+//expandCommand returns the argv of the command to run for this transition.
+//In shell mode, the expanded template is the script given to /bin/sh -c,
+//and the input paths followed by the output paths are its positional
+//parameters ($1, $2, ...), so that they never end up in the shell's source
+func (t *Transition) expandCommand() ([]string, error) {
+	return t.expandArgv(t.cmdTemplate, t.commandPaths())
+}
+
+//commandPaths returns the paths the command works on: the inputs, then
+//the (hidden) outputs
+func (t *Transition) commandPaths() []string {
+	return append(append([]string(nil), t.inputPaths...), t.stagingPaths...)
+}
+
+//expandArgv expands the given template into the argv of a command that is run
+//like the main one (see expandCommand), with the given paths as positional
+//parameters in shell mode
+func (t *Transition) expandArgv(tmplt *template.Template, paths []string) ([]string, error) {
+	expansion, err := t.execute(tmplt)
+	if err != nil {
+		return nil, err
+	}
+	if !t.shell {
+		return shellwords.Parse(expansion)
+	}
+	argv := []string{"/bin/sh", "-c", expansion, "pmjq"}
+	return append(argv, paths...), nil
+}
+
+//runHook runs the given hook of the job, and returns an error if it could not
+//be run or exited with a non zero status. Hooks are run like the command,
+//with the same environment, but without stdin, and with the given paths as
+//positional parameters in shell mode
+func (t *Transition) runHook(name string, hook *template.Template, paths []string) error {
+	if hook == nil {
+		return nil
+	}
+	argv, err := t.expandArgv(hook, paths)
+	if err != nil {
+		return err
+	}
+	if len(argv) == 0 {
+		return fmt.Errorf("The %v hook is empty", name)
+	}
+	logf(t, levelDebug, "Running %v hook %v", name, argv)
+	out, err := t.runAside(argv)
+	if err != nil {
+		return fmt.Errorf("%v hook %v failed (%v): %s", name, argv, err, out)
+	}
+	return nil
+}
+
+//runAside runs a command of the job other than the main one (a hook or the
+//validator), and returns its stdout and stderr. Like the main one, it is
+//run in its own process group, whose leftovers are killed once it exits.
+//It is killed if it runs for longer than hookTimeout
+func (t *Transition) runAside(argv []string) ([]byte, error) {
+	//The output goes to a file, as orphans holding a pipe would keep us
+	//waiting
+	out, err := ioutil.TempFile("", stagingPrefix+"hook-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = t.commandEnv()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: t.credential}
+	if err = startChild(cmd); err != nil {
+		return nil, err
+	}
+	pgid := cmd.Process.Pid
+	jobs.Lock()
+	jobs.groups[t] = pgid
+	jobs.Unlock()
+	term := time.AfterFunc(t.hookTimeout, func() {
+		logf(t, levelWarning, "%v is still running after %v, killing it", argv, t.hookTimeout)
+		syscall.Kill(-pgid, syscall.SIGTERM)
+	})
+	kill := time.AfterFunc(t.hookTimeout+killGrace, func() {
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	})
+	state, err := cmd.Process.Wait()
+	term.Stop()
+	kill.Stop()
+	jobs.Lock()
+	delete(jobs.groups, t)
+	jobs.Unlock()
+	reapGroup(t, pgid)
+	output, _ := ioutil.ReadFile(out.Name())
+	if err == nil && !state.Success() {
+		err = &exec.ExitError{ProcessState: state}
+	}
+	return output, err
+}
+
+//writtenPath returns the path in which the command wrote its ith output:
+//its staging file if the command wrote there, its final path if the command
+//computed it itself, or the empty string if the output was not written at all
+func (t *Transition) writtenPath(i int) string {
+	for _, p := range []string{t.stagingPaths[i], t.outputPaths[i]} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+//validate checks the post-conditions of the transition on the outputs
+//the command wrote, before they are committed and the inputs are removed
+func (t *Transition) validate() error {
+	var outputSize int64
+	written := make([]string, 0, len(t.outputPaths))
+	for i := range t.outputPaths {
+		p := t.writtenPath(i)
+		if p == "" {
+			if t.requireOutputs {
+				return fmt.Errorf("Output %v was not written", t.outputPaths[i])
+			}
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if t.requireNonEmpty && info.Size() == 0 {
+			return fmt.Errorf("Output %v is empty", t.outputPaths[i])
+		}
+		outputSize += info.Size()
+		written = append(written, p)
+	}
+	if t.minSizeRatio > 0 {
+		var inputSize int64
+		for _, p := range t.inputPaths {
+			info, err := os.Stat(p)
 			if err != nil {
-				log.Fatal(err)
+				return err
+			}
+			inputSize += info.Size()
+		}
+		if float64(outputSize) < t.minSizeRatio*float64(inputSize) {
+			return fmt.Errorf("Outputs weigh %v bytes, less than %v times the %v bytes of the inputs",
+				outputSize, t.minSizeRatio, inputSize)
+		}
+	}
+	if t.validatorTemplate != nil {
+		//The validator is run like cmd and the hooks, with the written
+		//outputs as positional parameters in shell mode, and as
+		//additional arguments otherwise
+		argv, err := t.expandArgv(t.validatorTemplate, written)
+		if err != nil {
+			return err
+		}
+		if !t.shell {
+			argv = append(argv, written...)
+		}
+		if len(argv) == 0 {
+			return errors.New("The validator is empty")
+		}
+		out, err := t.runAside(argv)
+		if err != nil {
+			return fmt.Errorf("Validator %v failed (%v): %s", argv, err, out)
+		}
+	}
+	return nil
+}
+
+//stdoutStaging returns the path of the file in which the command's stdout
+//is captured: the --stdout file if any, or else the only output.
+//It returns the empty string when stdout is to be discarded
+func (t *Transition) stdoutStaging() string {
+	if t.stdoutTemplate != nil {
+		return stagingPath(t.stdoutPath)
+	}
+	if len(t.teeOutputs) > 0 {
+		return t.stagingPaths[t.teeOutputs[0]]
+	}
+	if len(t.stagingPaths) == 1 {
+		return t.stagingPaths[0]
+	}
+	return ""
+}
+
+//commitOutputs renames the outputs the command wrote to their final name.
+//Outputs that were not written in their staging file (e.g. because the
+//command computed their final path itself) are left as they are
+func (t *Transition) commitOutputs() error {
+	finals := append([]string{}, t.outputPaths...)
+	stagings := append([]string{}, t.stagingPaths...)
+	if t.stdoutPath != "" {
+		finals = append(finals, t.stdoutPath)
+		stagings = append(stagings, stagingPath(t.stdoutPath))
+	}
+	for i := range stagings {
+		if _, err := os.Stat(stagings[i]); os.IsNotExist(err) {
+			continue
+		}
+		var err error
+		switch t.onExisting {
+		case existingSuffix:
+			err = publishUnique(stagings[i], finals[i])
+		case existingVersion:
+			err = keepVersion(finals[i])
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(stagings[i]); os.IsNotExist(err) {
+			continue //Published by publishUnique
+		}
+		logf(t, levelDebug, "Renaming %v to %v", stagings[i], finals[i])
+		err = os.Rename(stagings[i], finals[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//checkExisting applies the --on-existing policy to the outputs that already
+//exist, before the command is run. It returns the outcome of the job if it
+//must not be run, "" otherwise
+func (t *Transition) checkExisting() (string, error) {
+	t.existing = make([]bool, len(t.outputPaths))
+	var clashes []string
+	for i, p := range t.outputPaths {
+		if _, err := os.Lstat(p); err == nil {
+			t.existing[i] = true
+			clashes = append(clashes, p)
+		}
+	}
+	if len(clashes) == 0 {
+		return "", nil
+	}
+	err := fmt.Errorf("Output(s) %v already exist", strings.Join(clashes, ", "))
+	switch t.onExisting {
+	case existingSkip:
+		return outcomeSkip, err
+	case existingError:
+		return outcomeError, err
+	case existingSuffix:
+		for i, p := range t.outputPaths {
+			if t.existing[i] {
+				t.outputPaths[i] = uniquePath(p)
+				t.stagingPaths[i] = stagingPath(t.outputPaths[i])
+				t.existing[i] = false
+				logf(t, levelInfo, "%v already exists, writing to %v instead", p, t.outputPaths[i])
+			}
+		}
+	default:
+		logf(t, levelDebug, "%v, they will be replaced", err)
+	}
+	return "", nil
+}
+
+//uniquePath returns the first path that does not exist among the given one
+//with .1, .2, etc. inserted before its extension
+func uniquePath(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%v.%v%v", base, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+//publishUnique publishes the staging file under the final name, or, if
+//something else took that name in the meantime, under the next unique one
+//(see uniquePath)
+func publishUnique(staging, final string) error {
+	if _, err := os.Stat(staging); os.IsNotExist(err) {
+		return nil
+	}
+	for {
+		err := os.Link(staging, final)
+		if err == nil {
+			return os.Remove(staging)
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		final = uniquePath(final)
+	}
+}
+
+//keepVersion keeps the current version of the given output, if any, under
+//the hidden name .pmjq-v<n>-<name>, with n one more than the last version kept
+func keepVersion(final string) error {
+	if _, err := os.Lstat(final); os.IsNotExist(err) {
+		return nil
+	}
+	dir, file := filepath.Split(final)
+	for n := 1; ; n++ {
+		err := os.Link(final, path.Join(dir, fmt.Sprintf("%vv%v-%v", stagingPrefix, n, file)))
+		if err == nil || !os.IsExist(err) {
+			return err
+		}
+	}
+}
+
+//makeScratch creates the private scratch directory of the job, if the
+//transition asks for one
+func (t *Transition) makeScratch() error {
+	if t.scratchRoot == "" {
+		return nil
+	}
+	dir, err := ioutil.TempDir(t.scratchRoot, fmt.Sprintf("pmjq-%06v-", t.id))
+	if err != nil {
+		return err
+	}
+	t.Scratch = dir
+	return t.chown(dir)
+}
+
+//makeParent creates the missing directories in which the given file is to be
+//written, with the --dir-mode permissions. They are given to --user, if any
+func (t *Transition) makeParent(name string) error {
+	var missing []string
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		_, err := os.Stat(dir)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := os.Mkdir(missing[i], t.dirMode)
+		if os.IsExist(err) {
+			continue //Someone else made it in the meantime
+		}
+		if err != nil {
+			return err
+		}
+		logf(t, levelDebug, "Created directory %v", missing[i])
+		if err := os.Chmod(missing[i], t.dirMode); err != nil {
+			return err
+		}
+		if err := t.chown(missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//chown gives the file created by pmjq on behalf of the command to the user
+//the command is run as, so that they and the transitions downstream can
+//make use of it
+func (t *Transition) chown(name string) error {
+	if t.credential == nil {
+		return nil
+	}
+	return os.Chown(name, int(t.credential.Uid), int(t.credential.Gid))
+}
+
+//commandEnv returns the environment of the command: pmjq's own, plus
+//the location of the scratch directory, if any
+func (t *Transition) commandEnv() []string {
+	env := os.Environ()
+	if t.Scratch != "" {
+		env = append(env, "PMJQ_SCRATCH="+t.Scratch, "TMPDIR="+t.Scratch)
+	}
+	return env
+}
+
+//preserveScratch moves the scratch directory of a failed job next to
+//the first error file, so that one can see what the command left behind
+func (t *Transition) preserveScratch() {
+	if t.Scratch == "" {
+		return
+	}
+	dest := t.errorPaths[0] + ".scratch"
+	err := os.Rename(t.Scratch, dest)
+	if err != nil {
+		logf(t, levelWarning, "Could not move scratch dir %v to %v, leaving it in place: %v", t.Scratch, dest, err)
+		return
+	}
+	logf(t, levelInfo, "Scratch dir preserved in %v", dest)
+}
+
+//These are the possible outcomes of a job, depending on how its command exited
+const (
+	//outcomeSuccess publishes the outputs and removes the inputs
+	outcomeSuccess = "success"
+	//outcomeRetry discards the outputs and leaves the inputs for a later attempt
+	outcomeRetry = "retry"
+	//outcomeSkip discards the outputs and removes the inputs
+	outcomeSkip = "skip"
+	//outcomeError discards the outputs and moves the inputs to the error paths
+	outcomeError = "error"
+)
+
+//signals maps the names of the signals one may give in an --exit mapping
+//to their value
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGILL":  syscall.SIGILL,
+	"SIGABRT": syscall.SIGABRT,
+	"SIGBUS":  syscall.SIGBUS,
+	"SIGFPE":  syscall.SIGFPE,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGSEGV": syscall.SIGSEGV,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGPIPE": syscall.SIGPIPE,
+	"SIGALRM": syscall.SIGALRM,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGXCPU": syscall.SIGXCPU,
+	"SIGXFSZ": syscall.SIGXFSZ,
+}
+
+//parseExitMapping fills the given maps with the outcome associated
+//to an exit code or a signal by a <code or signal>:<outcome> string
+func parseExitMapping(mapping string, codes map[int]string, sigs map[syscall.Signal]string) error {
+	i := strings.LastIndex(mapping, ":")
+	if i < 0 {
+		return fmt.Errorf("--exit=%v: expected <code or signal>:<outcome>", mapping)
+	}
+	status, outcome := mapping[:i], mapping[i+1:]
+	switch outcome {
+	case outcomeSuccess, outcomeRetry, outcomeSkip, outcomeError:
+	default:
+		return fmt.Errorf("--exit=%v: unknown outcome %v", mapping, outcome)
+	}
+	if sig, ok := signals[strings.ToUpper(status)]; ok {
+		sigs[sig] = outcome
+		return nil
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 || code > 255 {
+		return fmt.Errorf("--exit=%v: %v is neither an exit code nor a known signal", mapping, status)
+	}
+	codes[code] = outcome
+	return nil
+}
+
+//outcome tells what to do with the job given the way its command
+//exited (i.e. the error returned by Wait)
+func (t *Transition) outcome(err error) string {
+	code := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return outcomeError
+		}
+		ws := exitErr.Sys().(syscall.WaitStatus)
+		if ws.Signaled() {
+			if outcome, ok := t.signalOutcomes[ws.Signal()]; ok {
+				return outcome
+			}
+			return outcomeError
+		}
+		code = ws.ExitStatus()
+	}
+	if outcome, ok := t.exitOutcomes[code]; ok {
+		return outcome
+	}
+	if code == 0 {
+		return outcomeSuccess
+	}
+	return outcomeError
+}
+
+//readAttempts returns the number of failed attempts at processing the inputs,
+//and the time of the last one. This count is kept next to the inputs so that
+//it survives restarts and is shared by all the instances of pmjq that watch
+//the same directories
+func (t *Transition) readAttempts() (int, time.Time) {
+	attempts := 0
+	var last time.Time
+	for _, p := range t.inputPaths {
+		n, when := t.readAttemptsOf(p)
+		if n > attempts {
+			attempts = n
+		}
+		if when.After(last) {
+			last = when
+		}
+	}
+	return attempts, last
+}
+
+//readAttemptsOf returns the number of failed attempts at processing the given
+//input, and the time of the last one
+func (t *Transition) readAttemptsOf(p string) (int, time.Time) {
+	b, err := ioutil.ReadFile(attemptsPath(p))
+	if err != nil {
+		return 0, time.Time{}
+	}
+	var n int
+	var unix int64
+	if _, err := fmt.Sscan(string(b), &n, &unix); err != nil {
+		logf(t, levelWarning, "Ignoring corrupted attempts counter %v: %v", attemptsPath(p), err)
+		return 0, time.Time{}
+	}
+	return n, time.Unix(unix, 0)
+}
+
+//due tells whether enough time has passed since the last failed
+//attempt at processing the inputs, and sets the number of the current attempt
+func (t *Transition) due() bool {
+	attempts, last := t.readAttempts()
+	t.attempt = attempts + 1
+	if attempts == 0 {
+		return true
+	}
+	delay := t.retryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return time.Since(last) >= delay
+}
+
+//recordAttempt writes the number of the failed attempt next to the inputs
+//(those that still exist)
+func (t *Transition) recordAttempt() error {
+	for _, p := range t.inputPaths {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		err := ioutil.WriteFile(attemptsPath(p),
+			[]byte(fmt.Sprintf("%v %v", t.attempt, time.Now().Unix())), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//forgetAttempts removes the attempts counters of the inputs
+func (t *Transition) forgetAttempts() {
+	for _, p := range t.inputPaths {
+		os.Remove(attemptsPath(p))
+	}
+}
+
+//attemptsPath returns the path of the attempts counter of the given input
+func attemptsPath(name string) string {
+	dir, file := filepath.Split(name)
+	return filepath.Join(dir, attemptsPrefix+file)
+}
+
+//discardOutputs removes the (probably incomplete, maybe nonexisting)
+//outputs of the command
+func (t *Transition) discardOutputs() {
+	for i := range t.outputPaths {
+		os.Remove(t.stagingPaths[i])
+		if i < len(t.existing) && t.existing[i] {
+			continue //Not ours
+		}
+		os.Remove(t.outputPaths[i])
+	}
+	if t.stdoutPath != "" {
+		os.Remove(stagingPath(t.stdoutPath))
+	}
+}
+
+//consumeInputs removes the processed files from the input folders,
+//archiving them first if asked to
+func (t *Transition) consumeInputs() error {
+	if t.doneTemplates == nil {
+		for _, fname := range t.inputPaths {
+			err := os.Remove(fname)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	t.donePaths = make([]string, len(t.doneTemplates))
+	for i := range t.doneTemplates {
+		var err error
+		t.donePaths[i], err = t.doneTemplates[i].ExecWithTransition(t)
+		if err == nil {
+			err = t.makeParent(t.donePaths[i])
+		}
+		if err != nil {
+			return err
+		}
+		if t.doneLink {
+			err = os.Link(t.inputPaths[i], t.donePaths[i])
+			if err == nil {
+				err = os.Remove(t.inputPaths[i])
 			}
-			defer t.inputFd.Close()
-			d2schan = goBucketDumper(t, "disk->stdin")
 		} else {
-			// With multiple inputs, we don't write to the command's stdin
-			go func() {
-				t.stdin.Close() //Explicitely prevent input on stdin
-				d2schan <- nil
-			}()
+			err = os.Rename(t.inputPaths[i], t.donePaths[i])
+		}
+		if err != nil {
+			return err
+		}
+		logf(t, levelInfo, "Archived file from %v to %v", t.inputPaths[i], t.donePaths[i])
+		if t.doneRetention > 0 {
+			if err := ioutil.WriteFile(archiveMarker(t.donePaths[i]), nil, 0644); err != nil {
+				logf(t, levelWarning, "Could not mark %v as archived, it will not be pruned: %v", t.donePaths[i], err)
+			}
+		}
+	}
+	return nil
+}
+
+//archiveMarker returns the path of the marker of the given archived file
+func archiveMarker(name string) string {
+	dir, file := filepath.Split(name)
+	return filepath.Join(dir, archivedPrefix+file)
+}
+
+//pruneArchives removes, every minute, the files of the done dirs that were
+//archived more than retention ago.
+//The time of archival is the mtime of the .pmjq-archived- marker written next
+//to the file when it was archived. Files without a marker are left alone
+func pruneArchives(seed *Transition, retention time.Duration) {
+	t := seed.Sapling()
+	t.custodian = "pruner"
+	for true {
+		for _, dt := range t.doneTemplates {
+			//Only the files with a marker were archived by pmjq, the
+			//marker being written when the file is archived
+			filepath.Walk(dt.dir, func(marker string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() || !strings.HasPrefix(info.Name(), archivedPrefix) {
+					return nil
+				}
+				if time.Since(info.ModTime()) < retention {
+					return nil
+				}
+				name := filepath.Join(filepath.Dir(marker), strings.TrimPrefix(info.Name(), archivedPrefix))
+				logf(&t, levelInfo, "Pruning archived file %v", name)
+				if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+					logf(&t, levelWarning, "Could not prune %v: %v", name, err)
+					return nil
+				}
+				os.Remove(marker)
+				return nil
+			})
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+//removeScratch removes the scratch directory of the job, if any
+func (t *Transition) removeScratch() {
+	if t.Scratch != "" {
+		os.RemoveAll(t.Scratch)
+	}
+}
+
+//sandboxEnv is the environment variable through which pmjq passes the
+//configuration of the sandbox to the copy of itself that sets it up
+const sandboxEnv = "PMJQ_SANDBOX"
+
+//sandboxConfig is what sandboxInit needs to know to set the sandbox up
+type sandboxConfig struct {
+	//Writable are the directories that stay writable, everything else is
+	//made read-only
+	Writable []string
+
+	//Credential is who the command is run as, as seen from inside the
+	//sandbox. If nil, it is run as root, albeit without any capability
+	Credential *syscall.Credential
+}
+
+//sandboxCommand returns the command that runs argv in a sandbox: a copy of
+//pmjq, in new user, mount, pid, ipc and (unless --sandbox-net) network
+//namespaces, that sets the sandbox up then executes argv (see sandboxInit)
+func (t *Transition) sandboxCommand(argv []string) (*exec.Cmd, error) {
+	conf := sandboxConfig{}
+	writable := []string{t.Scratch}
+	for _, staging := range t.stagingPaths {
+		writable = append(writable, filepath.Dir(staging))
+	}
+	for _, dir := range writable {
+		if dir == "" {
+			continue
+		}
+		//The mount points are compared with the real paths found in
+		//mountinfo
+		dir, err := filepath.Abs(dir)
+		if err == nil {
+			dir, err = filepath.EvalSymlinks(dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conf.Writable = append(conf.Writable, dir)
+	}
+	//Root in the sandbox is whoever runs pmjq, the user and groups of
+	//--user, --group and --groups are themselves
+	uidMappings := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	gidMappings := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	if t.credential != nil {
+		cred := syscall.Credential{Groups: make([]uint32, len(t.credential.Groups))}
+		uidMappings, cred.Uid = mapID(uidMappings, t.credential.Uid)
+		gidMappings, cred.Gid = mapID(gidMappings, t.credential.Gid)
+		for i, gid := range t.credential.Groups {
+			gidMappings, cred.Groups[i] = mapID(gidMappings, gid)
+		}
+		conf.Credential = &cred
+	}
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = argv
+	cmd.Env = append(t.commandEnv(), sandboxEnv+"="+string(b))
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC
+	if !t.sandboxNet {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:                    true,
+		Cloneflags:                 uintptr(flags),
+		UidMappings:                uidMappings,
+		GidMappings:                gidMappings,
+		GidMappingsEnableSetgroups: t.credential != nil,
+	}
+	return cmd, nil
+}
+
+//mapID adds the identity mapping of the given host id to the mappings, unless
+//it is already mapped, and returns the id as seen from inside the namespace
+func mapID(mappings []syscall.SysProcIDMap, id uint32) ([]syscall.SysProcIDMap, uint32) {
+	for _, m := range mappings {
+		if int(id) >= m.HostID && int(id) < m.HostID+m.Size {
+			return mappings, uint32(m.ContainerID + int(id) - m.HostID)
 		}
-		//Launch a worker that reads from the command and writes to disk
-		log.Printf("%v DEBUG Actual worker CP 1", t)
-		s2dchan := make(chan error)
-		if len(t.outputPaths) == 1 {
-			t.outputFd, err = os.Create(t.outputPaths[0])
+	}
+	return append(mappings, syscall.SysProcIDMap{ContainerID: int(id), HostID: int(id), Size: 1}), id
+}
+
+//sandboxInit is run instead of main by the copy of pmjq started by
+//sandboxCommand. It sets the sandbox up, then executes the command, whose
+//argv is its own. It never returns
+func sandboxInit() {
+	//The capabilities are dropped from this thread, it must thus be the one
+	//that executes the command
+	runtime.LockOSThread()
+	var conf sandboxConfig
+	err := json.Unmarshal([]byte(os.Getenv(sandboxEnv)), &conf)
+	os.Unsetenv(sandboxEnv)
+	if err == nil {
+		err = conf.setup()
+	}
+	var path string
+	if err == nil {
+		path, err = exec.LookPath(os.Args[0])
+	}
+	if err == nil {
+		err = syscall.Exec(path, os.Args, os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "pmjq: could not run %v in the sandbox: %v\n", os.Args, err)
+	os.Exit(127)
+}
+
+//mountpoints returns the mount points listed in /proc/self/mountinfo
+func mountpoints() ([]string, error) {
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	escaped := regexp.MustCompile(`\\[0-7]{3}`)
+	var mps []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		mps = append(mps, escaped.ReplaceAllStringFunc(fields[4], func(e string) string {
+			c, _ := strconv.ParseUint(e[1:], 8, 8)
+			return string([]byte{byte(c)})
+		}))
+	}
+	return mps, nil
+}
+
+//setup makes everything but the writable directories read-only, mounts
+//a /proc that only shows the processes of the sandbox, switches to
+//the credential of the command, and drops all the capabilities so that
+//the command can not undo any of this
+func (conf *sandboxConfig) setup() error {
+	//Nothing done here must be seen from outside of the sandbox
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("could not make the mounts private: %v", err)
+	}
+	writable := make(map[string]bool)
+	for _, dir := range conf.Writable {
+		if err := syscall.Mount(dir, dir, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("could not bind mount %v: %v", dir, err)
+		}
+		writable[dir] = true
+	}
+	mps, err := mountpoints()
+	if err != nil {
+		return err
+	}
+	for _, mp := range mps {
+		if writable[mp] {
+			continue
+		}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mp, &st); err != nil {
+			continue //Out of reach of the command anyway
+		}
+		//These flags may be locked, they must be kept as they are
+		flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+			syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+		if err := syscall.Mount("", mp, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, ""); err != nil {
+			return fmt.Errorf("could not make %v read-only: %v", mp, err)
+		}
+	}
+	//This fails when parts of pmjq's /proc are hidden, the command then
+	//sees all the processes, but can not do anything to them
+	syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	lastCap := 63
+	if b, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		lastCap, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	for c := 0; c <= lastCap; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(c), 0); errno != 0 {
+			return fmt.Errorf("could not drop capability %v: %v", c, errno)
+		}
+	}
+	if conf.Credential != nil {
+		groups := make([]int, len(conf.Credential.Groups))
+		for i, gid := range conf.Credential.Groups {
+			groups[i] = int(gid)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("could not set the groups: %v", err)
+		}
+		if err := syscall.Setgid(int(conf.Credential.Gid)); err != nil {
+			return fmt.Errorf("could not set the group: %v", err)
+		}
+		if err := syscall.Setuid(int(conf.Credential.Uid)); err != nil {
+			return fmt.Errorf("could not set the user: %v", err)
+		}
+	}
+	//The bounding set is now empty, so the command will not get any
+	//capability back when executed, even as root. The inheritable set
+	//must be emptied too
+	header := struct {
+		version uint32
+		pid     int32
+	}{linuxCapabilityVersion3, 0}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)),
+		uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("could not drop the capabilities: %v", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("could not forbid new privileges: %v", errno)
+	}
+	return nil
+}
+
+//run launches the command and feeds it, and returns once it is done.
+//The error is the one returned by Wait, or whatever prevented the command
+//from running properly
+func (t *Transition) run() error {
+	err := t.makeScratch()
+	if err != nil {
+		return err
+	}
+	if t.stdoutTemplate != nil {
+		t.stdoutPath, err = t.stdoutTemplate.ExecWithTransition(t)
+		if err != nil {
+			return err
+		}
+	}
+	if t.logTemplate != nil {
+		t.logPath, err = t.logTemplate.ExecWithTransition(t)
+		if err != nil {
+			return err
+		}
+		if t.attempt > 1 { //Keep the logs of the previous attempts
+			t.logPath = fmt.Sprintf("%v.%v", t.logPath, t.attempt)
+		}
+	}
+	//Expand the command
+	cmdArgv, err := t.expandCommand()
+	if err != nil {
+		return err
+	}
+	if len(cmdArgv) == 0 {
+		return errors.New("The command is empty")
+	}
+	//Open the files before the pipes, so that nothing is left dangling
+	//if one of them can not be opened
+	if len(t.stdinInputs) > 0 {
+		t.inputFd, err = t.openStdin()
+		logf(t, levelDebug, "Input file(s) just opened %v", t.inputFd)
+		if err != nil {
+			return err
+		}
+		defer t.inputFd.Close()
+	}
+	if t.stdoutStaging() != "" {
+		if err = t.makeParent(t.stdoutStaging()); err != nil {
+			return err
+		}
+		f, err := os.Create(t.stdoutStaging())
+		if err != nil {
+			return err
+		}
+		t.outputFd = f
+		//Whatever outputFd ends up being, as a compressor left open
+		//would wait for its input forever
+		defer func() { t.outputFd.Close() }()
+		if err = t.chown(t.stdoutStaging()); err != nil {
+			return err
+		}
+		if t.compress != nil {
+			w, err := t.compress.newWriter(f)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			defer t.outputFd.Close()
-			s2dchan = goBucketDumper(t, "stdout->disk")
+			t.outputFd = &compressedFile{w, f}
+		}
+	} else {
+		logf(t, levelDebug, "Discarding stdout")
+	}
+	if t.reportTemplate != nil {
+		t.stderrTail = &stderrTail{size: t.reportTail}
+		t.logFd = t.stderrTail
+	}
+	if t.logPath != "" {
+		if err = t.makeParent(t.logPath); err != nil {
+			return err
+		}
+		logFile, err := os.Create(t.logPath)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		if err = t.chown(t.logPath); err != nil {
+			return err
+		}
+		if t.stderrTail != nil {
+			t.stderrTail.next = logFile
+		} else {
+			t.logFd = logFile
+		}
+	}
+	//Launch the process
+	if t.sandbox {
+		t.cmd, err = t.sandboxCommand(cmdArgv)
+		if err != nil {
+			return err
+		}
+	} else {
+		t.cmd = exec.Command(cmdArgv[0], cmdArgv[1:]...)
+		t.cmd.Env = t.commandEnv()
+		//The command and all its descendants get a process group of their own,
+		//so that they can be signaled together
+		t.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: t.credential}
+	}
+	//Files are handed directly to the command, only the streams that need
+	//some work from us are piped. The unused ones are connected to /dev/null
+	//so that the command can neither wait for input nor block on a full pipe
+	//nobody reads
+	if f, ok := t.inputFd.(*os.File); ok {
+		t.cmd.Stdin = f
+	} else if t.inputFd != nil {
+		t.stdin, err = t.cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		defer t.stdin.Close()
+	}
+	if f, ok := t.outputFd.(*os.File); ok {
+		t.cmd.Stdout = f
+	} else if t.outputFd != nil {
+		t.stdout, err = t.cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		defer t.stdout.Close()
+	}
+	if f, ok := t.logFd.(*os.File); ok {
+		t.cmd.Stderr = f
+	} else if t.logFd != nil {
+		t.stderr, err = t.cmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+		defer t.stderr.Close()
+	}
+	err = startChild(t.cmd)
+	if err != nil {
+		return err
+	}
+	pgid := t.cmd.Process.Pid
+	jobs.Lock()
+	jobs.groups[t] = pgid
+	jobs.Unlock()
+	logf(t, levelDebug, "Command started \n")
+	progressDone := make(chan struct{})
+	defer close(progressDone)
+	go t.reportProgress(progressDone)
+	//Launch the workers that read from disk and write to the stdin of the
+	//command, and that read from the command and write to disk
+	var d2schan, s2dchan, e2dchan chan error
+	if t.stdin != nil {
+		d2schan = goBucketDumper(t, "disk->stdin")
+	}
+	if t.stdout != nil {
+		s2dchan = goBucketDumper(t, "stdout->disk")
+	}
+	if t.stderr != nil {
+		e2dchan = goBucketDumper(t, "stderr->disk")
+	}
+	//Wait for it to finish, then get rid of whatever it left behind, as
+	//orphans holding its stdout or stderr open would keep the dumpers waiting
+	logf(t, levelDebug, "Waiting for job to finish")
+	state, err := t.cmd.Process.Wait()
+	jobs.Lock()
+	delete(jobs.groups, t)
+	jobs.Unlock()
+	reapGroup(t, pgid)
+	var dumpErr error
+	if d2schan != nil {
+		//The command may very well exit without reading all of its input,
+		//this is not an error in itself, but not being able to read or
+		//decompress the input is
+		if err := <-d2schan; errors.Is(err, syscall.EPIPE) {
+			logf(t, levelDebug, "Command did not read all its input: %v", err)
+		} else if err != nil {
+			dumpErr = err
+		}
+	}
+	for _, c := range []chan error{s2dchan, e2dchan} {
+		if c != nil {
+			if err := <-c; err != nil && dumpErr == nil {
+				dumpErr = err
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !state.Success() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	if dumpErr != nil {
+		return dumpErr
+	}
+	return t.teeStdout()
+}
+
+//ficlone is the FICLONE ioctl, see ioctl_ficlone(2)
+const ficlone = 0x40049409
+
+//teeStdout gives the outputs selected by --tee, but the first one, the
+//content of the first one, in which stdout was captured. They are hard linked
+//to it if possible, else reflinked, else copied
+func (t *Transition) teeStdout() error {
+	if len(t.teeOutputs) < 2 {
+		return nil
+	}
+	src := t.stagingPaths[t.teeOutputs[0]]
+	for _, i := range t.teeOutputs[1:] {
+		dst := t.stagingPaths[i]
+		if err := os.Link(src, dst); err == nil {
+			continue
+		}
+		if err := cloneFile(src, dst); err != nil {
+			return fmt.Errorf("Could not tee stdout to %v: %v", t.outputPaths[i], err)
+		}
+		if err := t.chown(dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//cloneFile copies src to dst, as a reflink if the filesystem supports it
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+		_, err = io.Copy(out, in)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//parseTee returns the indices of the outputs designated by the given --tee
+//selector: 'all', or the comma-separated numbers (starting at 0) of
+//the outputs
+func parseTee(selector string, nbOutputs int) ([]int, error) {
+	var answer []int
+	if selector == "all" {
+		for i := 0; i < nbOutputs; i++ {
+			answer = append(answer, i)
+		}
+		return answer, nil
+	}
+	for _, field := range strings.Split(selector, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || i < 0 || i >= nbOutputs {
+			return nil, fmt.Errorf("--tee=%v: %v is not 'all' or the number of an --output (0 to %v)",
+				selector, field, nbOutputs-1)
+		}
+		for _, j := range answer {
+			if i == j {
+				return nil, fmt.Errorf("--tee=%v: %v is given twice", selector, i)
+			}
+		}
+		answer = append(answer, i)
+	}
+	return answer, nil
+}
+
+//signalJob sends sig to the process group of the job, if its command is running
+func (t *Transition) signalJob(sig syscall.Signal) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if pgid, ok := jobs.groups[t]; ok {
+		syscall.Kill(-pgid, sig)
+	}
+}
+
+//reapGroup gets rid of the processes left in the process group of a command
+//that has exited: they are sent a SIGTERM, then a SIGKILL if they are still
+//there after killGrace, and are reaped (pmjq being a child subreaper, the
+//orphans of the command are its children). Zombies whose parent is still
+//alive can not be got rid of, they are given up on after another killGrace
+func reapGroup(t *Transition, pgid int) {
+	if syscall.Kill(-pgid, 0) != nil {
+		return
+	}
+	logf(t, levelWarning, "The command left processes behind, killing them")
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	deadline := time.Now().Add(killGrace)
+	for syscall.Kill(-pgid, 0) == nil {
+		var ws syscall.WaitStatus
+		if pid, _ := syscall.Wait4(-pgid, &ws, syscall.WNOHANG, nil); pid > 0 {
+			continue
+		}
+		if time.Now().After(deadline.Add(killGrace)) {
+			logf(t, levelWarning, "Some processes left behind by the command would not go away, giving up on them")
+			return
+		}
+		if time.Now().After(deadline) {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//startChild starts the given command, and records it among the children
+func startChild(cmd *exec.Cmd) error {
+	children.Lock()
+	defer children.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if _, _, start, ok := procStat(cmd.Process.Pid); ok {
+		children.started[cmd.Process.Pid] = start
+	}
+	return nil
+}
+
+//procStat returns the state, the parent and the start time of the given
+//process, as found in /proc
+func procStat(pid int) (state byte, ppid int, start string, ok bool) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return
+	}
+	//The command, between parentheses, may contain anything
+	fields := strings.Fields(string(b[bytes.LastIndexByte(b, ')')+1:]))
+	if len(fields) < 20 {
+		return
+	}
+	ppid, err = strconv.Atoi(fields[1])
+	return fields[0][0], ppid, fields[19], err == nil
+}
+
+//reapOrphans reaps, whenever a child dies, the processes that were reparented
+//to pmjq and that reapGroup does not see, such as the daemons that left the
+//process group of their command. The children pmjq waits for itself are left
+//alone
+func reapOrphans() {
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	self := os.Getpid()
+	for range sigchld {
+		proc, err := os.Open("/proc")
+		if err != nil {
+			continue
+		}
+		names, _ := proc.Readdirnames(-1)
+		proc.Close()
+		children.Lock()
+		alive := make(map[int]bool)
+		for _, name := range names {
+			pid, err := strconv.Atoi(name)
+			if err != nil {
+				continue
+			}
+			state, ppid, start, ok := procStat(pid)
+			if !ok || ppid != self {
+				continue
+			}
+			if children.started[pid] == start {
+				alive[pid] = true
+			} else if state == 'Z' {
+				var ws syscall.WaitStatus
+				syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+			}
+		}
+		for pid := range children.started {
+			if !alive[pid] {
+				delete(children.started, pid) //Waited for already
+			}
+		}
+		children.Unlock()
+	}
+}
+
+//interruption returns why the job was killed from outside of its worker,
+//or "" if it was not
+func (t *Transition) interruption() string {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if jobs.stopping {
+		return "pmjq is stopping"
+	}
+	if jobs.lost[t] {
+		return "a lock was lost"
+	}
+	return ""
+}
+
+//stop kills the running jobs, waits for their workers to be done with them,
+//and exits
+func stop(seed *Transition, sig os.Signal) {
+	logf(seed, levelInfo, "Received %v, killing the running jobs", sig)
+	jobs.Lock()
+	jobs.stopping = true
+	for _, pgid := range jobs.groups {
+		syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	jobs.Unlock()
+	go func() {
+		time.Sleep(killGrace)
+		jobs.Lock()
+		for _, pgid := range jobs.groups {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+		jobs.Unlock()
+	}()
+	jobs.running.Wait()
+	logf(seed, levelInfo, "Exiting")
+	os.Exit(0)
+}
+
+//JobID returns an identifier of the job that is unique among all the
+//instances of pmjq
+func (t *Transition) JobID() string {
+	return fmt.Sprintf("%v-%06v", RandomNonce, t.id)
+}
+
+//failureReport is what is written, as JSON, when a job fails
+type failureReport struct {
+	Job        string    `json:"job"`
+	Host       string    `json:"host"`
+	Argv       []string  `json:"argv"`
+	ExitStatus *int      `json:"exit_status,omitempty"`
+	Signal     string    `json:"signal,omitempty"`
+	Error      string    `json:"error"`
+	Start      time.Time `json:"start"`
+	Duration   float64   `json:"duration_seconds"`
+	Attempt    int       `json:"attempt"`
+	Inputs     []string  `json:"inputs"`
+	Outputs    []string  `json:"outputs"`
+	Errors     []string  `json:"errors"`
+	Log        string    `json:"log,omitempty"`
+	Stderr     string    `json:"stderr_tail"`
+}
+
+//writeReport writes the JSON report of the failed job, if asked to
+func (t *Transition) writeReport(cause error) {
+	if t.reportTemplate == nil {
+		return
+	}
+	host, _ := os.Hostname()
+	report := failureReport{
+		Job:      t.JobID(),
+		Host:     host,
+		Error:    fmt.Sprintf("%v", cause),
+		Start:    t.start,
+		Duration: time.Since(t.start).Seconds(),
+		Attempt:  t.attempt,
+		Inputs:   t.inputPaths,
+		Outputs:  t.outputPaths,
+		Errors:   t.errorPaths,
+		Log:      t.logPath,
+	}
+	if t.cmd != nil {
+		report.Argv = t.cmd.Args
+	}
+	if exitErr, ok := cause.(*exec.ExitError); ok {
+		ws := exitErr.Sys().(syscall.WaitStatus)
+		if ws.Signaled() {
+			report.Signal = ws.Signal().String()
 		} else {
-			// With multiple outputs, we don't write the command's stdout
-			// (FIXME: This output is lost)
-			go func() {
-				s2dchan <- nil
-			}()
+			status := ws.ExitStatus()
+			report.ExitStatus = &status
 		}
-		//Launch a worker that reads from the command's stderr and logs it
-		log.Printf("%v DEBUG Actual worker CP 2", t)
-		var e2dchan chan error
-		if t.logTemplate != nil {
-			t.logPath = t.logTemplate.ExecWithTransition(t)
-			t.logFd, err = os.Create(t.logPath)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer t.logFd.Close()
-			e2dchan = goBucketDumper(t, "stderr->disk")
+	}
+	if t.stderrTail != nil {
+		report.Stderr = string(t.stderrTail.data)
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		var name string
+		name, err = t.reportTemplate.ExecWithTransition(t)
+		if err == nil {
+			err = t.makeParent(name)
 		}
-		//Wait for it to finish
-		log.Printf("%v DEBUG Waiting for job to finish", t)
-		<-d2schan
-		<-s2dchan
-		if e2dchan != nil {
-			<-e2dchan
+		if err == nil {
+			err = ioutil.WriteFile(name, append(b, '\n'), 0644)
 		}
-		return t.cmd.Wait()
-	}(); err != nil {
-		if t.errorTemplates == nil {
-			log.Fatal(err)
+	}
+	if err != nil {
+		logf(t, levelWarning, "Could not write the failure report: %v", err)
+	}
+}
+
+//reject handles the inputs of a failed job: they are moved to the error
+//paths if there are any, and left in place to be tried again later otherwise
+func (t *Transition) reject(cause error) {
+	t.discardOutputs()
+	if t.errorTemplates == nil {
+		logf(t, levelError, "Job failed (%v), leaving the inputs in place", cause)
+		if err := t.recordAttempt(); err != nil {
+			logf(t, levelError, "Could not record the failed attempt: %v", err)
+		}
+		t.writeReport(cause)
+		if err := t.runHook("on-failure", t.onFailureTemplate, t.inputPaths); err != nil {
+			logf(t, levelWarning, "%v", err)
+		}
+		t.removeScratch()
+		return
+	}
+	//Move the input files to the error_dirs
+	t.errorPaths = make([]string, len(t.errorTemplates))
+	for i := range t.errorTemplates {
+		var err error
+		t.errorPaths[i], err = t.errorTemplates[i].ExecWithTransition(t)
+		if err == nil {
+			err = t.makeParent(t.errorPaths[i])
 		}
-		//Move the input files to the error_dirs
-		t.errorPaths = make([]string, len(t.errorTemplates))
-		for i := range t.errorTemplates {
-			t.errorPaths[i] = t.errorTemplates[i].ExecWithTransition(t)
+		if err == nil {
 			err = os.Rename(t.inputPaths[i], t.errorPaths[i])
-			log.Printf("%v ERROR Rejected file from %v to %v (%v)",
-				t, t.inputPaths[i],
-				t.errorPaths[i],
-				t.logPath)
-			if err != nil {
-				log.Fatal(err)
+		}
+		if err != nil {
+			logf(t, levelError, "Job failed (%v), and its input %v could not be moved to the error dir: %v", cause, t.inputPaths[i], err)
+			if err := t.recordAttempt(); err != nil {
+				logf(t, levelError, "Could not record the failed attempt: %v", err)
 			}
+			return
+		}
+		logf(t, levelError, "Rejected file from %v to %v (%v)", t.inputPaths[i],
+			t.errorPaths[i],
+			t.logPath)
+	}
+	t.forgetAttempts()
+	t.writeReport(cause)
+	if err := t.runHook("on-failure", t.onFailureTemplate, t.errorPaths); err != nil {
+		logf(t, levelWarning, "%v", err)
+	}
+	t.preserveScratch()
+}
+
+//settle does what the outcome of the job asks for with its inputs and outputs
+//(see outcome())
+func (t *Transition) settle(outcome string, cause error) {
+	switch outcome {
+	case outcomeError:
+		t.reject(cause)
+	case outcomeRetry:
+		logf(t, levelWarning, "Attempt %v failed (%v), leaving the inputs for a later attempt", t.attempt, cause)
+		if err := t.recordAttempt(); err != nil {
+			logf(t, levelError, "Could not record the failed attempt: %v", err)
 		}
-		// //Remove the (probably incomplete, maybe nonexisting) output file
-		for i := range t.outputPaths {
-			os.Remove(t.outputPaths[i])
+		t.discardOutputs()
+		t.removeScratch()
+	case outcomeSkip:
+		logf(t, levelInfo, "Command exited (%v), discarding the inputs", cause)
+		t.discardOutputs()
+		if err := t.consumeInputs(); err != nil {
+			logf(t, levelError, "Could not remove the inputs: %v", err)
 		}
-	} else {
-		//Remove the file from the input folder
-		for _, fname := range t.inputPaths {
-			err = os.Remove(fname)
-			if err != nil {
-				log.Fatal(err)
-			}
+		t.forgetAttempts()
+		t.removeScratch()
+	default:
+		//Publish the outputs
+		if err := t.commitOutputs(); err != nil {
+			logf(t, levelError, "Could not publish the outputs: %v", err)
+			t.reject(err)
+			return
 		}
+		if err := t.consumeInputs(); err != nil {
+			logf(t, levelError, "Could not remove the inputs: %v", err)
+		}
+		t.forgetAttempts()
+		paths := append(append([]string(nil), t.outputPaths...), t.donePaths...)
+		if err := t.runHook("on-success", t.onSuccessTemplate, paths); err != nil {
+			logf(t, levelWarning, "%v", err)
+		}
+		t.removeScratch()
+	}
+}
+
+//The actualWorkers are tasked with launching and monitoring the data processing tasks.
+//They receive their transition as an argument, and they output their id
+//on the outputChannel once they are done.
+//Whatever happens to the job, the worker does not bring the whole daemon down
+//with it: the failure is confined to the job's inputs and outputs
+func actualWorker(t *Transition, id int, outputChannel chan<- int) {
+	t.custodian = fmt.Sprintf("worker%v", id)
+	t.workerID = id
+	jobs.Lock()
+	if jobs.stopping {
+		jobs.Unlock()
+		t.releaseLocks()
+		outputChannel <- id
+		return
+	}
+	jobs.running.Add(1)
+	jobs.Unlock()
+	t.work()
+	t.releaseLocks()
+	jobs.Lock()
+	delete(jobs.lost, t)
+	jobs.Unlock()
+	jobs.running.Done()
+	outputChannel <- id
+}
+
+//work runs the job and settles its outcome
+func (t *Transition) work() {
+	t.start = time.Now()
+	logf(t, levelDebug, "Starting\n")
+	if outcome, err := t.checkExisting(); outcome != "" {
+		t.settle(outcome, err)
+		return
+	}
+	if err := t.runHook("pre-run", t.preRunTemplate, t.commandPaths()); err != nil {
+		if why := t.interruption(); why != "" {
+			logf(t, levelWarning, "Pre-run hook killed because %v (%v), leaving the inputs in place", why, err)
+			return
+		}
+		//A veto is handled like a retry, so that the hook is not run again
+		//before --retry-delay
+		logf(t, levelInfo, "Job vetoed by the pre-run hook: %v", err)
+		outcome := outcomeRetry
+		if t.retries > 0 && t.attempt > t.retries {
+			outcome = outcomeError
+		}
+		t.settle(outcome, err)
+		return
+	}
+	err := t.run()
+	if why := t.interruption(); why != "" {
+		logf(t, levelWarning, "Job killed because %v (%v), leaving the inputs in place", why, err)
+		t.discardOutputs()
+		t.removeScratch()
+		return
 	}
-	//Release the file locks
+	outcome := t.outcome(err)
+	logf(t, levelDebug, "Command exited (%v), outcome is %v", err, outcome)
+	if outcome == outcomeSuccess {
+		err = t.validate()
+		if err != nil {
+			logf(t, levelError, "Invalid output: %v", err)
+			outcome = outcomeError
+		}
+	} else if err == nil {
+		err = fmt.Errorf("exit status 0 means %v", outcome)
+	}
+	if outcome == outcomeError && t.attempt <= t.retries {
+		outcome = outcomeRetry
+	} else if outcome == outcomeRetry && t.retries > 0 && t.attempt > t.retries {
+		outcome = outcomeError
+	}
+	t.settle(outcome, err)
+}
+
+//releaseLocks releases the locks on the inputs and outputs of the job
+func (t *Transition) releaseLocks() {
 	for i := 0; i < len(t.inputPaths)+len(t.outputPaths); i++ {
-		log.Printf("%v DEBUG Releasing lock %v\n", t, i)
+		logf(t, levelDebug, "Releasing lock %v\n", i)
 		t.lockRelease <- 0
 	}
-	outputChannel <- id
+	t.lockHolders.Wait()
 }
 
 //The spawner worker has a few slots for actual_workers to be launched.
@@ -820,107 +3287,647 @@ func spawner(seed *Transition,
 	t := seed.Sapling()
 	t.custodian = "spawner"
 	for true {
-		log.Printf("%v DEBUG Waiting for an available worker", &t)
+		logf(&t, levelDebug, "Waiting for an available worker")
 		i = <-availableWorkers
-		log.Printf("%v DEBUG worker %v waiting on locker\n", &t, i)
+		logf(&t, levelDebug, "worker %v waiting on locker\n", i)
 		lockerSpawnerSynchro <- i //Signal locker that we are ready
 		//to work by sending it a waiting token
 		select {
 		case i = <-lockerSpawnerSynchro: //Locker gives us our token back: it could
 			//not get the locks
-			log.Printf("%v DEBUG received token %v, putting it back to the pool\n", &t, i)
+			logf(&t, levelDebug, "received token %v, putting it back to the pool\n", i)
 			go func(j int) { availableWorkers <- j }(i)
 		case t := <-fromLocker:
 			t.custodian = "spawner"
-			log.Printf("%v DEBUG Assigning to worker %v\n", t, i)
+			logf(t, levelDebug, "Assigning to worker %v\n", i)
 			go actualWorker(t, i, availableWorkers) //Launch the actual worker
 		}
 	}
 }
 
+//newTemplate parses a template in which a reference to a missing named match
+//is an error rather than an empty string
+func newTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+}
+
+//newDirTemplate parses a (directory, template) couple given on the command
+//line. An unspecified template defaults to defaultTmplt
+func newDirTemplate(name string, dirtemplate string, defaultTmplt string) (*DirTemplate, error) {
+	dir, tmplt := filepath.Split(dirtemplate)
+	if tmplt == "" {
+		tmplt = defaultTmplt
+	}
+	answer, err := newTemplate(name, tmplt)
+	if err != nil {
+		return nil, err
+	}
+	return &DirTemplate{dir, tmplt, *answer}, nil
+}
+
+//newSeed builds the seed transition from the command line arguments.
+//It does not stop at the first problem, but reports all of them
+func newSeed(arguments map[string]interface{}) (*Transition, []error) {
+	problems := []error{}
+	report := func(option string, value interface{}, err error) {
+		problems = append(problems, fmt.Errorf("%v=%v: %v", option, value, err))
+	}
+	seed := &Transition{
+		id:              0,
+		custodian:       "Seed",
+		inputPatterns:   make([]*DirPattern, 0, len(arguments["--input"].([]string))),
+		outputTemplates: make([]*DirTemplate, 0, len(arguments["--output"].([]string))),
+		shell:           arguments["--shell"].(bool),
+		requireNonEmpty: arguments["--require-nonempty"].(bool),
+		requireOutputs:  arguments["--require-outputs"].(bool),
+		exitOutcomes:    make(map[int]string),
+		signalOutcomes:  make(map[syscall.Signal]string),
+		doneLink:        arguments["--done-link"].(bool),
+	}
+	var err error
+	seed.cmdTemplate, err = newTemplate("Command", arguments["<cmdtemplate>"].(string))
+	if err != nil {
+		report("<cmdtemplate>", arguments["<cmdtemplate>"], err)
+	}
+	if arguments["--scratch"] != nil {
+		seed.scratchRoot = arguments["--scratch"].(string)
+	}
+	for _, inpattern := range arguments["--input"].([]string) {
+		dir, pattern := filepath.Split(inpattern)
+		if dir == "" {
+			dir = "./" //Unspecified dir defaults to the current one
+		}
+		if pattern == "" {
+			pattern = ".*" //Unspecified pattern defaults to all files
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			report("--input", inpattern, err)
+			continue
+		}
+		seed.inputPatterns = append(seed.inputPatterns, &DirPattern{dir, pattern, *re})
+	}
+	nbInputs := len(arguments["--input"].([]string))
+	if nbInputs > 1 {
+		if arguments["--invariant"] == nil {
+			problems = append(problems, errors.New("--invariant must be specified when there are several --input"))
+		} else {
+			seed.invariantTemplate = arguments["--invariant"].(string)
+		}
+	} else if arguments["--invariant"] != nil {
+		problems = append(problems, errors.New("--invariant must only be specified when there are several --input"))
+	}
+	for i, outtemplate := range arguments["--output"].([]string) {
+		//Unspecified template defaults to same name as first input file
+		dt, err := newDirTemplate(fmt.Sprintf("Output file %v", i), outtemplate, "{{.Input 0}}")
+		if err != nil {
+			report("--output", outtemplate, err)
+			continue
+		}
+		seed.outputTemplates = append(seed.outputTemplates, dt)
+	}
+	if n := len(arguments["--error"].([]string)); n > 0 && n != nbInputs {
+		problems = append(problems, fmt.Errorf("There are %v --error but %v --input, there must be as many", n, nbInputs))
+	}
+	for _, errtemplate := range arguments["--error"].([]string) {
+		//Unspecified template defaults to same name as first input file
+		dt, err := newDirTemplate("One of the errors", errtemplate, "{{.Input 0}}")
+		if err != nil {
+			report("--error", errtemplate, err)
+			continue
+		}
+		seed.errorTemplates = append(seed.errorTemplates, dt)
+	}
+	if arguments["--min-size-ratio"] != nil {
+		seed.minSizeRatio, err = strconv.ParseFloat(arguments["--min-size-ratio"].(string), 64)
+		if err != nil {
+			report("--min-size-ratio", arguments["--min-size-ratio"], err)
+		}
+	}
+	if arguments["--validator"] != nil {
+		seed.validatorTemplate, err = newTemplate("Validator", arguments["--validator"].(string))
+		if err != nil {
+			report("--validator", arguments["--validator"], err)
+		}
+	}
+	hooks := []struct {
+		option   string
+		template **template.Template
+	}{
+		{"--pre-run", &seed.preRunTemplate},
+		{"--on-success", &seed.onSuccessTemplate},
+		{"--on-failure", &seed.onFailureTemplate},
+	}
+	for _, hook := range hooks {
+		if arguments[hook.option] != nil {
+			*hook.template, err = newTemplate(hook.option, arguments[hook.option].(string))
+			if err != nil {
+				report(hook.option, arguments[hook.option], err)
+			}
+		}
+	}
+	seed.hookTimeout, err = time.ParseDuration(arguments["--hook-timeout"].(string))
+	if err != nil || seed.hookTimeout <= 0 {
+		report("--hook-timeout", arguments["--hook-timeout"], errors.New("not a positive duration"))
+	}
+	for _, mapping := range arguments["--exit"].([]string) {
+		err = parseExitMapping(mapping, seed.exitOutcomes, seed.signalOutcomes)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	seed.retries, err = strconv.Atoi(arguments["--retries"].(string))
+	if err != nil || seed.retries < 0 {
+		report("--retries", arguments["--retries"], errors.New("not a non-negative integer"))
+	}
+	seed.retryDelay, err = time.ParseDuration(arguments["--retry-delay"].(string))
+	if err != nil {
+		report("--retry-delay", arguments["--retry-delay"], err)
+	}
+	if n := len(arguments["--done"].([]string)); n > 0 && n != nbInputs {
+		problems = append(problems, fmt.Errorf("There are %v --done but %v --input, there must be as many", n, nbInputs))
+	}
+	for i, donetemplate := range arguments["--done"].([]string) {
+		//Unspecified template defaults to same name as the input file
+		dt, err := newDirTemplate(fmt.Sprintf("Done file %v", i), donetemplate, fmt.Sprintf("{{.Input %v}}", i))
+		if err != nil {
+			report("--done", donetemplate, err)
+			continue
+		}
+		seed.doneTemplates = append(seed.doneTemplates, dt)
+	}
+	if arguments["--done-retention"] != nil {
+		seed.doneRetention, err = time.ParseDuration(arguments["--done-retention"].(string))
+		if err != nil {
+			report("--done-retention", arguments["--done-retention"], err)
+		}
+	}
+	if arguments["--stdout"] != nil {
+		//Unspecified template defaults to same name as first input file
+		seed.stdoutTemplate, err = newDirTemplate("The stdout file", arguments["--stdout"].(string), "{{.Input 0}}")
+		if err != nil {
+			report("--stdout", arguments["--stdout"], err)
+		}
+	}
+	if arguments["--stderr"] != nil {
+		//Unspecified template defaults to same name as first input file
+		seed.logTemplate, err = newDirTemplate("The log file", arguments["--stderr"].(string), "{{.Input 0}}")
+		if err != nil {
+			report("--stderr", arguments["--stderr"], err)
+		}
+	}
+	if arguments["--report"] != nil {
+		seed.reportTemplate, err = newDirTemplate("The report file", arguments["--report"].(string), "{{.Input 0}}.json")
+		if err != nil {
+			report("--report", arguments["--report"], err)
+		}
+	}
+	seed.reportTail, err = strconv.Atoi(arguments["--report-tail"].(string))
+	if err != nil || seed.reportTail < 0 {
+		report("--report-tail", arguments["--report-tail"], errors.New("not a non-negative integer"))
+	}
+	seed.reportTail *= 1024
+	seed.credential, err = parseCredential(arguments["--user"], arguments["--group"], arguments["--groups"])
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if f := arguments["--dry-run-format"].(string); f != "text" && f != "json" {
+		report("--dry-run-format", f, errors.New("must be 'text' or 'json'"))
+	}
+	seed.sandbox = arguments["--sandbox"].(bool)
+	seed.sandboxNet = arguments["--sandbox-net"].(bool)
+	if seed.sandboxNet && !seed.sandbox {
+		problems = append(problems, errors.New("--sandbox-net is meaningless without --sandbox"))
+	}
+	seed.umask = -1
+	if arguments["--umask"] != nil {
+		umask, err := strconv.ParseUint(arguments["--umask"].(string), 8, 32)
+		if err != nil || umask > 0777 {
+			report("--umask", arguments["--umask"], errors.New("not an octal mode"))
+		}
+		seed.umask = int(umask)
+	}
+	if arguments["--stdin"] != nil {
+		seed.stdinInputs, seed.stdinFramed, err = parseStdin(arguments["--stdin"].(string), seed.inputPatterns)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	} else if nbInputs == 1 {
+		seed.stdinInputs = []int{0}
+	}
+	dirMode, err := strconv.ParseUint(arguments["--dir-mode"].(string), 8, 32)
+	if err != nil || dirMode > 07777 {
+		report("--dir-mode", arguments["--dir-mode"], errors.New("not an octal mode"))
+	}
+	seed.dirMode = os.FileMode(dirMode)
+	seed.onExisting = arguments["--on-existing"].(string)
+	switch seed.onExisting {
+	case existingOverwrite, existingSkip, existingError, existingSuffix, existingVersion:
+	default:
+		report("--on-existing", seed.onExisting, errors.New("must be 'overwrite', 'skip', 'error', 'suffix' or 'version'"))
+	}
+	if arguments["--tee"] != nil {
+		seed.teeOutputs, err = parseTee(arguments["--tee"].(string), len(seed.outputTemplates))
+		if err != nil {
+			problems = append(problems, err)
+		}
+		if seed.stdoutTemplate != nil {
+			problems = append(problems, errors.New("--tee and --stdout can not be used together"))
+		}
+	}
+	if arguments["--decompress"] != nil {
+		name := arguments["--decompress"].(string)
+		seed.decompress = codecs[name]
+		seed.autoDecompress = name == "auto"
+		if seed.decompress == nil && !seed.autoDecompress {
+			report("--decompress", name, fmt.Errorf("must be 'auto' or one of %v", strings.Join(codecNames(), ", ")))
+		}
+		if seed.stdinFramed {
+			problems = append(problems, errors.New("--decompress can not be used with --stdin=framed"))
+		}
+	}
+	if arguments["--compress"] != nil {
+		name := arguments["--compress"].(string)
+		seed.compress = codecs[name]
+		if seed.compress == nil {
+			report("--compress", name, fmt.Errorf("must be one of %v", strings.Join(codecNames(), ", ")))
+		}
+		if seed.stdoutTemplate == nil && len(seed.outputTemplates) != 1 && seed.teeOutputs == nil {
+			problems = append(problems, errors.New("--compress needs stdout to be captured, with --stdout, --tee or a single --output"))
+		}
+	}
+	return seed, problems
+}
+
+//lookupGroup returns the gid of the given group name or number
+func lookupGroup(name string) (uint32, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		if _, notNumber := strconv.Atoi(name); notNumber != nil {
+			return 0, err
+		}
+		g, err = user.LookupGroupId(name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), err
+}
+
+//parseCredential returns the credential the commands should be run as, given
+//the values of --user, --group and --groups, or nil if none was given.
+//The group defaults to the primary group of the user, and the supplementary
+//groups to the groups the user is a member of
+func parseCredential(userArg, groupArg, groupsArg interface{}) (*syscall.Credential, error) {
+	if userArg == nil && groupArg == nil && groupsArg == nil {
+		return nil, nil
+	}
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	var u *user.User
+	if userArg != nil {
+		var err error
+		u, err = user.Lookup(userArg.(string))
+		if _, notNumber := strconv.Atoi(userArg.(string)); err != nil && notNumber == nil {
+			u, err = user.LookupId(userArg.(string))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("--user: %v", err)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("--user: %v", err)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("--user: %v", err)
+		}
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+	}
+	if groupArg != nil {
+		gid, err := lookupGroup(groupArg.(string))
+		if err != nil {
+			return nil, fmt.Errorf("--group: %v", err)
+		}
+		cred.Gid = gid
+	}
+	var groups []string
+	if groupsArg != nil {
+		groups = strings.Split(groupsArg.(string), ",")
+	} else if u != nil {
+		var err error
+		groups, err = u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("--user: could not list the groups of %v: %v", u.Username, err)
+		}
+	}
+	cred.Groups = []uint32{}
+	for _, name := range groups {
+		if name == "" {
+			continue
+		}
+		gid, err := lookupGroup(name)
+		if err != nil {
+			return nil, fmt.Errorf("--groups: %v", err)
+		}
+		cred.Groups = append(cred.Groups, gid)
+	}
+	return cred, nil
+}
+
+//checkParent checks that the given directory can be created, if it does not
+//exist, or else that it is a writable directory
+func checkParent(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return checkDir(dir)
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+//checkDir makes sure that the given directory exists and that we can
+//create and remove files in it
+func checkDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, stagingPrefix+"check-")
+	if err != nil {
+		return fmt.Errorf("%v is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+//probe returns a fake job of the seed, on which the templates can be tried
+func (seed *Transition) probe() *Transition {
+	t := *seed
+	t.custodian = "probe"
+	t.isProbe = true
+	t.NamedMatches = make(map[string]string)
+	for i, dp := range seed.inputPatterns {
+		name := fmt.Sprintf("input%v", i)
+		t.inputFiles = append(t.inputFiles, name)
+		t.inputPaths = append(t.inputPaths, path.Join(dp.dir, name))
+		t.inputs = append(t.inputs, InputFile{Name: name, Path: path.Join(dp.dir, name), Dir: dp.dir})
+		for _, subexp := range dp.pattern.SubexpNames() {
+			t.NamedMatches[subexp] = subexp
+		}
+	}
+	t.Invariant = "invariant"
+	if t.scratchRoot != "" {
+		t.Scratch = path.Join(t.scratchRoot, "scratch")
+	}
+	return &t
+}
+
+//check reports the problems of the seed that only show when confronting it
+//with the filesystem, or when expanding its templates
+func (seed *Transition) check() []error {
+	problems := []error{}
+	for _, dp := range seed.inputPatterns {
+		if err := checkDir(dp.dir); err != nil {
+			problems = append(problems, fmt.Errorf("--input=%v: %v", dp, err))
+		}
+	}
+	if seed.scratchRoot != "" {
+		if err := checkDir(seed.scratchRoot); err != nil {
+			problems = append(problems, fmt.Errorf("--scratch=%v: %v", seed.scratchRoot, err))
+		}
+	}
+	//The output templates are expanded before all the others, they
+	//can not refer to the outputs
+	t := seed.probe()
+	for i, dt := range seed.outputTemplates {
+		p, err := dt.ExecWithTransition(t)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("--output=%v: %v", dt, err))
+			p = path.Join(dt.dir, fmt.Sprintf("output%v", i))
+		}
+		t.outputPaths = append(t.outputPaths, p)
+		t.stagingPaths = append(t.stagingPaths, stagingPath(p))
+	}
+	dirTemplates := []struct {
+		option    string
+		templates []*DirTemplate
+	}{
+		{"--output", seed.outputTemplates},
+		{"--error", seed.errorTemplates},
+		{"--done", seed.doneTemplates},
+		{"--stdout", []*DirTemplate{seed.stdoutTemplate}},
+		{"--stderr", []*DirTemplate{seed.logTemplate}},
+		{"--report", []*DirTemplate{seed.reportTemplate}},
+	}
+	for _, dts := range dirTemplates {
+		for _, dt := range dts.templates {
+			if dt == nil {
+				continue
+			}
+			if err := checkParent(dt.dir); err != nil {
+				problems = append(problems, fmt.Errorf("%v=%v: %v", dts.option, dt, err))
+			}
+			if dts.option == "--output" {
+				continue //Already expanded
+			}
+			if _, err := dt.ExecWithTransition(t); err != nil {
+				problems = append(problems, fmt.Errorf("%v=%v: %v", dts.option, dt, err))
+			}
+		}
+	}
+	if seed.cmdTemplate != nil {
+		if _, err := t.expandCommand(); err != nil {
+			problems = append(problems, fmt.Errorf("<cmdtemplate>: %v", err))
+		}
+	}
+	otherTemplates := []struct {
+		option   string
+		template *template.Template
+	}{
+		{"--validator", seed.validatorTemplate},
+		{"--pre-run", seed.preRunTemplate},
+		{"--on-success", seed.onSuccessTemplate},
+		{"--on-failure", seed.onFailureTemplate},
+	}
+	for _, other := range otherTemplates {
+		if other.template != nil {
+			if _, err := t.expandArgv(other.template, nil); err != nil {
+				problems = append(problems, fmt.Errorf("%v: %v", other.option, err))
+			}
+		}
+	}
+	return problems
+}
+
 func main() {
+	if os.Getenv(sandboxEnv) != "" {
+		sandboxInit()
+	}
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	usage := `pmjq.
 
 	Usage: pmjq  [--quit-when-empty] --input=<inpattern>... [--invariant=<re_template>] <cmdtemplate> --output=<outtemplate>... [--stderr=<logtemplate>] [--error=<errortemplate>...]
+	             [--shell] [--scratch=<scratchroot>] [--stdout=<stdouttemplate>]
+	             [--stdin=<selector>]
+	             [--require-nonempty] [--require-outputs] [--min-size-ratio=<ratio>] [--validator=<validatortemplate>]
+	             [--exit=<mapping>...] [--retries=<n>] [--retry-delay=<delay>]
+	             [--done=<donetemplate>...] [--done-link] [--done-retention=<age>]
+	             [--pre-run=<hooktemplate>] [--on-success=<hooktemplate>] [--on-failure=<hooktemplate>] [--hook-timeout=<delay>]
+	             [--report=<reporttemplate>] [--report-tail=<kb>]
+	             [--user=<user>] [--group=<group>] [--groups=<groups>] [--umask=<mask>]
+	             [--sandbox] [--sandbox-net]
+	             [--dry-run] [--dry-run-format=<format>]
+	             [--log-level=<level>] [--log-format=<format>]
+	             [--decompress=<codec>] [--compress=<codec>] [--tee=<outputs>]
+	             [--on-existing=<policy>] [--dir-mode=<mode>]
 	       pmjq -h | --help
 	       pmjq --version
 
   Options:
      --help -h                  Show this message
      --version                  Show version information and exit
-     --quit-when-empty          Exit with 0 status when the input dir is empty
-     --input=<inpattern>        The regex a file must match in order to be processed
+     --quit-when-empty          Exit with 0 status when the input dir is empty, not counting the inputs of failed jobs that were left in place after their last attempt (see --retries).
+     --input=<inpattern>        The regex a file must match in order to be processed. With only one --input, the file is fed to cmd's stdin. With several, see --stdin.
      --invariant=<re_template>  Must only be specified if multiple input patterns are passed. Iff the regex template expansion is the same for all --input matches, the matching files are processed together.
-     --output=<outtemplate>     The name of the output file(s) are the expansion of this(ese) template(s), using the DSL of Golang's text/template. Templates ending in / when there is only one input and one output will result in the input file's name being used as the output file's name.
+     --stdin=<selector>         Choose what is fed to cmd's stdin: the input whose number (starting at 0) or whose directory's name is given, 'concat' for all the inputs one after the other in the order of the --input patterns, 'framed' for the same but with each input preceded by its size in bytes written in decimal and followed by a newline, or 'none' for /dev/null. Defaults to the input when there is only one, and to 'none' otherwise. In --shell mode, all the input paths are given as positional parameters anyway, so that a filter can read one input on stdin and the others from "$2", "$3", etc.
+     --output=<outtemplate>     The name of the output file(s) are the expansion of this(ese) template(s), using the DSL of Golang's text/template. Templates ending in / when there is only one input and one output will result in the input file's name being used as the output file's name. Outputs are first written in a hidden file of the same directory (whose name starts with .pmjq-), which is renamed once cmd succeeds, so that nobody sees an incomplete output. Commands that write their outputs themselves should write them in {{.Output 0}}, {{.Output 1}}, etc.
+     --stdout=<stdouttemplate>  The name of the file where each instance of cmd will dump its stdout is the expansion of this template, whatever the number of --output. Without it, stdout is captured in the output file when there is only one --output, in the outputs given by --tee, and discarded otherwise. Templates ending in / will result in the first input file's name being used as the stdout file's name.
+     --require-nonempty         Consider that cmd failed if it wrote an empty output.
+     --require-outputs          Consider that cmd failed if it did not write all of its outputs.
+     --min-size-ratio=<ratio>   Consider that cmd failed if the total size of its outputs is less than <ratio> times the total size of its inputs.
+     --validator=<validatortemplate>  The expansion of this template is run once cmd has succeeded, like cmd (see --shell), with the paths of the outputs cmd wrote as additional arguments (in --shell mode, as its positional parameters "$1", "$2", etc.). If it fails, cmd is considered to have failed. All these checks are made before the outputs are published and the inputs removed, a failure has the same consequences as a failure of cmd (see --error).
+     --exit=<mapping>           Map an exit code or a signal to an outcome, e.g. --exit=75:retry --exit=SIGTERM:retry --exit=3:skip. The outcome can be 'success' (publish the outputs, remove the inputs), 'retry' (discard the outputs, leave the inputs for a later attempt), 'skip' (discard the outputs, remove the inputs) or 'error' (discard the outputs, handle the inputs as specified by --error). By default, 0 means success and anything else means error.
+     --retries=<n>              Try a failed job again <n> times before handling its inputs as specified by --error. Jobs whose outcome is 'retry' are then also given up after <n> retries, instead of being tried again forever. The number of attempts is kept in a hidden .pmjq-attempts-<input> file next to each input, so that it survives restarts and is shared by all the instances of pmjq watching the same directories. The stderr of each retry is kept in the log file suffixed by the number of the attempt. [default: 0]
+     --retry-delay=<delay>      How long to wait before the first retry of a failed job, e.g. 30s, 5m. This delay doubles with each failed attempt, up to one hour. [default: 30s]
+     --done=<donetemplate>      If specified, there must be as many as there are --input. Once processed, the input files are not removed but moved to their new name(s) given by the expansion of these template(s). Templates ending in / will result in the input file's name being used as the archived file's name.
+     --done-link                Archive the input files by hard linking them to their new name, then removing them, instead of renaming them. Contrary to a renaming, this fails instead of replacing an already archived file of the same name.
+     --done-retention=<age>     Remove the archived files once they have been archived for longer than <age>, e.g. 720h. pmjq marks each file it archives with a hidden .pmjq-archived-<name> file next to it, and only ever removes the marked files: whatever else is stored in the --done directories is left alone.
+     --pre-run=<hooktemplate>   The expansion of this template is run before each instance of cmd. If it fails, cmd is not run, and the job is handled as if cmd asked to be retried (see --exit): the inputs are left in place for a later attempt (see --retries and --retry-delay).
+     --on-success=<hooktemplate>  The expansion of this template is run once the outputs of a successful instance of cmd have been published. In --shell mode, its positional parameters are the final paths of the outputs, followed by those of the archived inputs (see --done), if any: the inputs themselves are gone. Likewise, refer to the outputs as {{.OutputPath 0}}, etc., as {{.Output 0}} is gone too.
+     --on-failure=<hooktemplate>  The expansion of this template is run once the inputs of a failed instance of cmd have been handled as specified by --error. In --shell mode, its positional parameters are the paths the inputs were moved to (see --error), or those of the inputs if they were left in place. Hooks are run like cmd (see --shell), with the same environment, but with nothing on their stdin. A failed hook is logged along with its output, and apart from the pre-run one, has no consequence.
+     --hook-timeout=<delay>     Kill the hooks and the validator when they run for longer than this, e.g. 30s, 5m, which makes them fail. Like cmd, they are run in their own process group, and the processes they leave behind are killed once they exit. [default: 10m]
      --stderr=<logtemplate>     The name of the log file where each instance of cmd will dump it stderr is the expansion of this template. Templates ending in / will result in the first input file's name being used as the log file's name.
-     --error=<error-dir>        If specified, there must be as many as there are --input. If specified, pmjq does not crash on error but move the incriminated file(s) to their new name(s) given by the expansion of these template(s). Templates ending in / when there is only one input and one output will result in the input file's name being used as the error file's name.
+     --error=<error-dir>        If specified, there must be as many as there are --input. If specified, pmjq moves the incriminated file(s) of a failed job to their new name(s) given by the expansion of these template(s). Otherwise, they are left in place, to be tried again later (see --retry-delay). Templates ending in / when there is only one input and one output will result in the input file's name being used as the error file's name.
+     --report=<reporttemplate>  When a job fails, write a JSON report in the file whose name is the expansion of this template (e.g. /errors/{{.Input 0}}.json). It holds the job id, the host, the command's argv, its exit status or the signal that killed it, its start date and duration, the attempt number, the input, output, error and log paths, and the end of its stderr.
+     --report-tail=<kb>         How many kilobytes of the end of stderr to include in the report. [default: 4]
+     --user=<user>              Run cmd, the hooks and the validator as this user (name or uid) instead of pmjq's own. The files pmjq creates for cmd (stdout, log file, scratch directory) are given to this user, so that the transitions downstream, that may run as yet another user, can read them.
+     --group=<group>            Run cmd, the hooks and the validator with this group (name or gid). Defaults to the primary group of --user.
+     --groups=<groups>          Comma-separated list of the supplementary groups (names or gids) of cmd, the hooks and the validator. Defaults to the groups --user is a member of.
+     --umask=<mask>             The umask, in octal (e.g. 027), with which pmjq and thus cmd create their files.
+     --decompress=<codec>       Decompress the inputs before feeding them to cmd's stdin (see --stdin), with this codec: gzip, xz or zstd, or 'auto' to detect which one was used on each input from its first bytes (inputs that do not look compressed are fed as they are). xz and zstd need the eponymous programs. Can not be used with --stdin=framed, as the sizes of the decompressed inputs are not known in advance.
+     --compress=<codec>         Compress cmd's stdout with this codec (gzip, xz or zstd) before writing it to the output (or the --stdout file).
+     --tee=<outputs>            Write cmd's stdout to each of these outputs: 'all', or the comma-separated numbers (starting at 0) of the --output. stdout is captured in the first one, the others are hard links to it if possible, else reflinks, else copies. Can not be used with --stdout.
+     --on-existing=<policy>     What to do, before running cmd, when some of its outputs already exist: 'overwrite' them, 'skip' the job and remove its inputs, handle its inputs as a failure ('error', see --error), give the outputs a 'suffix' (.1, .2, etc. before their extension), or replace them but keep the previous 'version' under the hidden name .pmjq-v<n>-<name> (hidden names are not seen by pmjq as inputs). Either way, an output that existed before a failed job is left untouched. [default: overwrite]
+     --dir-mode=<mode>          The permissions, in octal, of the directories pmjq creates when the expansion of an --output, --error, --done, --stdout, --stderr or --report template lies in a directory that does not exist. [default: 755]
+     --log-level=<level>        Only log the messages of this level or a more severe one: DEBUG, INFO, WARNING or ERROR. [default: DEBUG]
+     --log-format=<format>      Log as 'text' (the format lnav_pmjq.json describes), or as 'json' lines with typed fields (time, level, file, id, job, custodian, worker, inputs, outputs, log, pid, msg). [default: text]
+     --dry-run                  Instead of running anything, list the jobs that would be run right now, as they would be run: their inputs, invariant, named matches, command, and output, error, log, etc. paths. Also list the conflicts between these jobs, such as two jobs writing to the same output path. pmjq then exits, with status 1 if there is any conflict or any job whose templates can not be expanded.
+     --dry-run-format=<format>  Print the dry run as 'text' or 'json'. [default: text]
+     --sandbox                  Run cmd in a sandbox, made of new Linux user, mount, pid, ipc and network namespaces. In it, everything is read-only, including the inputs, except the directories of the outputs and the scratch directory. cmd only sees its own processes, has no network, and no capability even if it is run as root. pmjq must be allowed to create user namespaces.
+     --sandbox-net              Let cmd use the network of the host from within the sandbox.
+     --shell                    Run the expanded command with /bin/sh -c, so that it can use pipes, redirections, etc. The input paths, then the (hidden) output paths, are given to the shell as positional parameters: refer to them as "$1", "$2", ... and never through the template (e.g. {{.Input 0}}), as the template expansion is pasted verbatim in the shell's source: a file named '$(rm -rf ~)' would be run. If you must, use {{.Input 0 | shellquote}}.
+     --scratch=<scratchroot>    Create a private scratch directory for each instance of cmd in this directory. Its path is available as {{.Scratch}} in the command template, and as $PMJQ_SCRATCH and $TMPDIR in the command's environment. It is removed once the command succeeds. If the command fails, it is moved next to the first error file, with a .scratch suffix.
+
+  Templates:
+     All the templates (cmd, --output, --error, --stderr, --stdout, --done, --report, --validator and the hooks) are expanded with the job's data:
+     .Input I                   The name of the Ith input file (starting at 0), in the order of the --input patterns.
+     .InputPath I               The path of the Ith input file.
+     .Inputs                    The list of the inputs, to range over, e.g. {{range .Inputs}}{{.Path}} {{end}}. Each has a .Name, .Path, .Dir (that of its --input pattern), .Size in bytes, .Mtime (a Golang time.Time, e.g. {{.Mtime.Format "2006-01-02"}}) and .Mode.
+     .Invariant                 The expansion of --invariant.
+     .NamedMatches.NAME         The submatch of the (?P<NAME>...) group of the --input patterns.
+     .Output I                  The hidden path in which cmd must write its Ith output, if it writes it itself.
+     .OutputPath I              The final path of the Ith output.
+     .Outputs                   The list of the final paths of the outputs.
+     .LogPath                   The path of the --stderr log file, or an empty string.
+     .Scratch                   The private scratch directory (see --scratch), or an empty string.
+     .JobID                     An identifier of the job, unique among all the instances of pmjq.
+     .Worker                    The number of the worker running the job, starting at 0.
+     .Attempt                   The number of the attempt at running the job, starting at 1 (see --retries).
+     The --output templates are expanded before anything else: there, .Output, .OutputPath, .Outputs and .LogPath can not be used, and the worker and the attempt are not known yet (.Worker and .Attempt are 0).
+     They can also use these functions, in addition to those of Golang's text/template. Those that transform a string take it last, so that they can be chained, e.g. {{.Input 0 | stripext | upper}}.
+     basename, dirname, ext     The last element, all but the last element, and the extension (with its dot) of a path.
+     stripext                   A path without its extension.
+     replace OLD NEW            Replace all the occurrences of OLD.
+     regexReplace RE REPL       Replace all the matches of the regex RE by REPL, which can refer to submatches as $1, ${name}, etc.
+     lower, upper               Change the case.
+     date LAYOUT                The current date, formatted as LAYOUT, Golang-style (e.g. "2006-01-02T15:04:05").
+     mtime LAYOUT PATH          The modification date of the file PATH, formatted as LAYOUT.
+     hostname                   The name of the host.
+     uuid, ulid                 A new random UUID, or a new ULID (which sort by creation date).
+     sha256                     The hex SHA-256 hash of a string.
+     env NAME                   The value of the environment variable NAME, or an empty string.
+     shellquote                 Quote a string so that the shell reads it as one word.
 `
 	arguments, err := docopt.Parse(usage, nil, true, "Poor Man's Job Queue, v 1.0.0β", false)
 	if err != nil {
 		log.Fatal(err)
 	}
-	//log.Println("pmjq started")
-	//log.Println(arguments)
-	seed := Transition{
-		id:              0,
-		custodian:       "Seed",
-		inputPatterns:   make([]*DirPattern, 0, len(arguments["--input"].([]string))),
-		outputTemplates: make([]*DirTemplate, 0, len(arguments["--output"].([]string))),
-		cmdTemplate:     template.Must(template.New("Command").Parse(arguments["<cmdtemplate>"].(string))),
-	}
-	//log.Printf("%v DEBUG Initial seed\n", seed)
-	for _, inpattern := range arguments["--input"].([]string) {
-		dir, pattern := filepath.Split(inpattern)
-		if pattern == "" {
-			pattern = ".*" //Unspecified pattern defaults to all files
+	//Logging is set up first, so that everything that follows is logged
+	//as asked
+	minLevel = -1
+	for l, name := range levelNames {
+		if strings.EqualFold(name, arguments["--log-level"].(string)) {
+			minLevel = logLevel(l)
 		}
-		seed.inputPatterns = append(seed.inputPatterns,
-			&DirPattern{dir, pattern, *regexp.MustCompile(pattern)})
 	}
-	//log.Printf("%v DEBUG Input patterns\n", seed)
-	for i, outtemplate := range arguments["--output"].([]string) {
-		dir, tmplt := filepath.Split(outtemplate)
-		if tmplt == "" {
-			tmplt = "{{.Input 0}}" //Unspecified template defaults to same name as first input file
-		}
-		seed.outputTemplates = append(seed.outputTemplates,
-			&DirTemplate{dir, tmplt,
-				*template.Must(template.New(fmt.Sprintf("Output file %v", i)).Parse(tmplt))})
+	if minLevel < 0 {
+		log.Fatalf("--log-level=%v: must be one of %v", arguments["--log-level"], strings.Join(levelNames, ", "))
 	}
-	log.Printf("%v DEBUG Output templates\n", &seed)
-	if len(arguments["--error"].([]string)) > 0 {
-		for _, errtemplate := range arguments["--error"].([]string) {
-			dir, tmplt := filepath.Split(errtemplate)
-			if tmplt == "" {
-				tmplt = "{{.Input 0}}" //Unspecified template defaults to same name as first input file
-			}
-			seed.errorTemplates = append(seed.errorTemplates,
-				&DirTemplate{dir, tmplt,
-					*template.Must(template.New("One of the errors").Parse(tmplt))})
-		}
+	switch arguments["--log-format"].(string) {
+	case "text":
+	case "json":
+		jsonLogs = true
+		log.SetFlags(0)
+	default:
+		log.Fatalf("--log-format=%v: must be 'text' or 'json'", arguments["--log-format"])
 	}
-	if arguments["--stderr"] != nil {
-		dir, tmplt := filepath.Split(arguments["--stderr"].(string))
-		if tmplt == "" {
-			tmplt = "{{.Input 0}}" //Unspecified template defaults to same name as first input file
+	//log.Println("pmjq started")
+	//log.Println(arguments)
+	seed, problems := newSeed(arguments)
+	problems = append(problems, seed.check()...)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			logf(seed, levelError, "%v", problem)
 		}
-		seed.logTemplate = &DirTemplate{dir, tmplt,
-			*template.Must(template.New("The log file").Parse(tmplt))}
+		log.Fatalf("Found %v problem(s) in the transition, exiting", len(problems))
+	}
+	logf(seed, levelDebug, "Seed is ready\n")
+	if arguments["--dry-run"].(bool) {
+		os.Exit(dryRun(seed, arguments["--dry-run-format"].(string)))
 	}
-	if len(arguments["--input"].([]string)) > 1 {
-		seed.invariantTemplate = arguments["--invariant"].(string)
+	//The files pmjq creates and those its commands create get the same
+	//permissions
+	if seed.umask >= 0 {
+		syscall.Umask(seed.umask)
 	}
-	// cmd_argv, err := shellwords.Parse(arguments["<filter>"].(string))
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	//Become the parent of the orphans of the commands, so that they can be
+	//reaped (see reapGroup)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		logf(seed, levelWarning, "Could not become a child subreaper: %v", errno)
+	}
+	go reapOrphans()
+	stopSignals := make(chan os.Signal, 1)
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	go func() { stop(seed, <-stopSignals) }()
 	fromDirListerToLocker := make(chan *Transition)
-	go dirLister(&seed, fromDirListerToLocker, arguments["--quit-when-empty"].(bool))
+	go dirLister(seed, fromDirListerToLocker, arguments["--quit-when-empty"].(bool))
 	fromLockerToSpawner := make(chan *Transition)
 	lockerSpawnerSynchro := make(chan int)
 	go locker(fromDirListerToLocker, lockerSpawnerSynchro, fromLockerToSpawner)
-	go spawner(&seed, lockerSpawnerSynchro, fromLockerToSpawner, 4)
+	go spawner(seed, lockerSpawnerSynchro, fromLockerToSpawner, 4)
+	if seed.doneRetention > 0 {
+		go pruneArchives(seed, seed.doneRetention)
+	}
 
 	time.Sleep(3 * time.Second)
 	//log.Println("Exiting.")
@@ -166,11 +166,14 @@ def normalize(transition, root=None):
     if 'id' not in transition:
         transition['id'] = transition['cmd']
     root = os.path.abspath(root) if root is not None else ""
-    for key in [k for k in ['inputs', 'outputs', 'errors'] if k in transition]:
+    for key in [k for k in ['inputs', 'outputs', 'errors', 'done']
+                if k in transition]:
         for i in [x for x in range(len(transition[key]))
                   if not os.path.isabs(transition[key][x])]:
             transition[key][i] = os.path.join(root, transition[key][i])
-    for key in [k for k in ["log", "stderr"] if k in transition]:
+    for key in [k for k in ["log", "stderr", "stdout_file", "scratch",
+                            "report"]
+                if k in transition]:
         if not os.path.isabs(transition[key]):
             transition[key] = os.path.join(root, transition[key])
     return transition
@@ -180,9 +183,16 @@ def endpoints(transition):
     """Return the list of endpoints: the dirs that need to exist for the transition
     to run"""
     return list(map(lambda d: os.path.dirname(smart_unquote(d)),
-                    sum([transition[x] for x in ['inputs', 'outputs', 'errors']
+                    sum([transition[x] for x in ['inputs', 'outputs', 'errors',
+                                                 'done']
                          if x in transition], []) +
-                    ([transition['stderr']] if 'stderr' in transition else [])))
+                    ([transition['stderr']] if 'stderr' in transition else []) +
+                    ([transition['stdout_file']]
+                     if 'stdout_file' in transition else []) +
+                    ([transition['report']]
+                     if 'report' in transition else []) +
+                    ([os.path.join(transition['scratch'], '')]
+                     if 'scratch' in transition else [])))
 
 
 def pmjq_command(transition, redirect="&>"):
@@ -195,14 +205,75 @@ def pmjq_command(transition, redirect="&>"):
                            transition["inputs"])) + " "
     if "invariant" in transition:
         answer += "--invariant="+transition["invariant"]+" "
+    if "stdin_from" in transition:
+        answer += "--stdin="+str(transition["stdin_from"])+" "
     answer += transition["cmd"]+" "
     answer += " ".join(map(lambda template: "--output="+template,
                            transition["outputs"]))+" "
+    if "require_nonempty" in transition and transition["require_nonempty"]:
+        answer += "--require-nonempty "
+    if "require_outputs" in transition and transition["require_outputs"]:
+        answer += "--require-outputs "
+    if "min_size_ratio" in transition:
+        answer += "--min-size-ratio="+str(transition["min_size_ratio"])+" "
+    if "validator" in transition:
+        answer += "--validator="+transition["validator"]+" "
+    if "exit_outcomes" in transition:
+        answer += " ".join("--exit={}:{}".format(status, outcome)
+                           for status, outcome
+                           in transition["exit_outcomes"].items())+" "
+    if "retries" in transition:
+        answer += "--retries="+str(transition["retries"])+" "
+    if "retry_delay" in transition:
+        answer += "--retry-delay="+transition["retry_delay"]+" "
+    if "stdout_file" in transition:
+        answer += "--stdout="+transition["stdout_file"]+" "
     if "stderr" in transition:
         answer += "--stderr="+transition["stderr"]+" "
     if "errors" in transition:
         answer += " ".join(map(lambda tmplt: "--error="+tmplt,
                                transition["errors"]))+" "
+    if "done" in transition:
+        answer += " ".join(map(lambda tmplt: "--done="+tmplt,
+                               transition["done"]))+" "
+    if "done_link" in transition and transition["done_link"]:
+        answer += "--done-link "
+    if "done_retention" in transition:
+        answer += "--done-retention="+transition["done_retention"]+" "
+    for hook in ["pre_run", "on_success", "on_failure"]:
+        if hook in transition:
+            answer += "--"+hook.replace("_", "-")+"="+transition[hook]+" "
+    if "hook_timeout" in transition:
+        answer += "--hook-timeout="+transition["hook_timeout"]+" "
+    if "report" in transition:
+        answer += "--report="+transition["report"]+" "
+    if "report_tail" in transition:
+        answer += "--report-tail="+str(transition["report_tail"])+" "
+    for key in ["user", "group", "umask"]:
+        if key in transition:
+            answer += "--"+key+"="+str(transition[key])+" "
+    if "groups" in transition:
+        answer += "--groups="+",".join(map(str, transition["groups"]))+" "
+    if "tee" in transition:
+        answer += "--tee="+(transition["tee"] if transition["tee"] == "all"
+                            else ",".join(map(str, transition["tee"])))+" "
+    if "on_existing" in transition:
+        answer += "--on-existing="+transition["on_existing"]+" "
+    if "dir_mode" in transition:
+        answer += "--dir-mode="+str(transition["dir_mode"])+" "
+    for key in ["decompress", "compress"]:
+        if key in transition:
+            answer += "--"+key+"="+transition[key]+" "
+    for key in ["log_level", "log_format"]:
+        if key in transition:
+            answer += "--"+key.replace("_", "-")+"="+transition[key]+" "
+    for flag in ["sandbox", "sandbox_net"]:
+        if flag in transition and transition[flag]:
+            answer += "--"+flag.replace("_", "-")+" "
+    if "shell" in transition and transition["shell"]:
+        answer += "--shell "
+    if "scratch" in transition:
+        answer += "--scratch="+transition["scratch"]+" "
     if "log" in transition:
         answer += redirect + " " + transition["log"]
     return answer
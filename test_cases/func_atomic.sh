@@ -0,0 +1,62 @@
+#!/usr/bin/env bash
+# Outputs are written in hidden staging files, renamed once the command
+# succeeds: a failed command leaves no output, and no staging file is left
+# behind, whether pmjq captures stdout or the command writes its outputs itself
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+rm -rf ${PLAYGROUND}/output1
+rm -rf ${PLAYGROUND}/error
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+mkdir -p ${PLAYGROUND}/output1
+mkdir -p ${PLAYGROUND}/error
+
+check_outputs() {
+    for dir in "$@"; do
+        if [ ! -f ${dir}/OK.txt ]; then
+            echo "OK file was not processed"
+            exit 1
+        fi
+        if [ -e ${dir}/error.txt ]; then
+            echo "A failed command left an output"
+            exit 1
+        fi
+        if [ -n "$(find ${dir} -name '.pmjq-*')" ]; then
+            echo "A staging file was left behind"
+            exit 1
+        fi
+    done
+}
+
+# stdout is captured by pmjq
+echo OK > ${PLAYGROUND}/input/OK.txt
+echo error > ${PLAYGROUND}/input/error.txt
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' 'grep -v error' --output=${PLAYGROUND}/output/ \
+     --error=${PLAYGROUND}/error/ &> ${PLAYGROUND}/pmjq.log
+
+check_outputs ${PLAYGROUND}/output
+
+# The outputs are written by the command, which fails after writing them
+rm -rf ${PLAYGROUND}/output/* ${PLAYGROUND}/error/*
+echo OK > ${PLAYGROUND}/input/OK.txt
+echo error > ${PLAYGROUND}/input/error.txt
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'cp "$1" "$2" && cp "$1" "$3" && ! grep -q error "$1"' \
+     --output=${PLAYGROUND}/output/ --output=${PLAYGROUND}/output1/'{{.Input 0}}' \
+     --error=${PLAYGROUND}/error/ &>> ${PLAYGROUND}/pmjq.log
+
+check_outputs ${PLAYGROUND}/output ${PLAYGROUND}/output1
+
+if [ ! -f ${PLAYGROUND}/error/error.txt ]; then
+    echo "Error-triggering file was not put in error dir"
+    exit 1
+fi
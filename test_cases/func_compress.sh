@@ -0,0 +1,24 @@
+#!/usr/bin/env bash
+# --decompress=auto feeds cmd the decompressed inputs, whether they were
+# compressed or not, and --compress compresses its stdout
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+
+echo compressed | gzip > ${PLAYGROUND}/input/a
+echo plain > ${PLAYGROUND}/input/b
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' 'tr a-z A-Z' --output=${PLAYGROUND}/output/ \
+     --decompress=auto --compress=gzip &> ${PLAYGROUND}/pmjq.log
+
+test "$(gzip -dc ${PLAYGROUND}/output/a)" = COMPRESSED
+test "$(gzip -dc ${PLAYGROUND}/output/b)" = PLAIN
@@ -0,0 +1,29 @@
+#!/usr/bin/env bash
+# The missing directories of the outputs are created with the --dir-mode
+# permissions
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+
+echo OK > ${PLAYGROUND}/input/OK.txt
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' cat --output=${PLAYGROUND}/output/sub/deep/ --dir-mode=750 &> ${PLAYGROUND}/pmjq.log
+
+if [ ! -f ${PLAYGROUND}/output/sub/deep/OK.txt ]; then
+    echo "OK file was not processed"
+    exit 1
+fi
+
+if [ "$(stat -c %a ${PLAYGROUND}/output/sub)" != 750 ] || [ "$(stat -c %a ${PLAYGROUND}/output/sub/deep)" != 750 ]; then
+    echo "The output dirs were not created with the --dir-mode permissions"
+    exit 1
+fi
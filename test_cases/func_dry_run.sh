@@ -0,0 +1,37 @@
+#!/usr/bin/env bash
+# --dry-run lists the jobs without running them, and flags two jobs that
+# would write the same output
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+
+touch ${PLAYGROUND}/input/a-1 ${PLAYGROUND}/input/a-2 ${PLAYGROUND}/input/b-1
+
+pmjq --dry-run --input="${PLAYGROUND}/input/(?P<stem>[a-z])-[0-9]" 'tr a-z A-Z' --output="${PLAYGROUND}/output/{{.NamedMatches.stem}}" > ${PLAYGROUND}/plan.txt 2> ${PLAYGROUND}/pmjq.log && exit 1
+
+grep -x "CONFLICT ${PLAYGROUND}/output/a would be written by jobs .*" ${PLAYGROUND}/plan.txt
+test "$(grep -c '^Job ' ${PLAYGROUND}/plan.txt)" = 3
+
+if [ "$(ls ${PLAYGROUND}/input | wc -l)" != 3 ] || [ -n "$(ls ${PLAYGROUND}/output)" ]; then
+    echo "The dry run touched the files"
+    exit 1
+fi
+
+# A template that can not be expanded for an actual job is reported as a
+# problem, and the templates that follow it are left out
+rm -rf ${PLAYGROUND}/input/a-2 ${PLAYGROUND}/input/b-1
+
+pmjq --dry-run --input="${PLAYGROUND}/input/.*" cat --output=${PLAYGROUND}/output/ \
+     --error=${PLAYGROUND}/error/'{{mtime "2006" (printf "%v.missing" (.InputPath 0))}}' \
+     --stderr=${PLAYGROUND}/log/ > ${PLAYGROUND}/plan.txt 2> ${PLAYGROUND}/pmjq.log && exit 1
+
+grep "^  PROBLEM: .*a-1.missing" ${PLAYGROUND}/plan.txt
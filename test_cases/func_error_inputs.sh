@@ -0,0 +1,44 @@
+#!/usr/bin/env bash
+# The description of the inputs (.Inputs) is taken when the job is listed, so
+# that the --error templates of a failed job with several inputs can still use
+# it once the first input has been moved
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input0
+rm -rf ${PLAYGROUND}/input1
+rm -rf ${PLAYGROUND}/output
+rm -rf ${PLAYGROUND}/error0
+rm -rf ${PLAYGROUND}/error1
+
+mkdir -p ${PLAYGROUND}/input0
+mkdir -p ${PLAYGROUND}/input1
+mkdir -p ${PLAYGROUND}/output
+mkdir -p ${PLAYGROUND}/error0
+mkdir -p ${PLAYGROUND}/error1
+
+echo first > ${PLAYGROUND}/input0/job
+echo second input > ${PLAYGROUND}/input1/job
+
+pmjq --quit-when-empty \
+     --input=${PLAYGROUND}/input0/'.*' \
+     --input=${PLAYGROUND}/input1/'.*' \
+     --invariant='$0' \
+     false \
+     --output=${PLAYGROUND}/output/'{{.Invariant}}' \
+     --error=${PLAYGROUND}/error0/'{{range .Inputs}}{{.Size}}-{{end}}{{.Input 0}}' \
+     --error=${PLAYGROUND}/error1/'{{range .Inputs}}{{.Size}}-{{end}}{{.Input 1}}' &> ${PLAYGROUND}/pmjq.log
+
+if [ ! -f ${PLAYGROUND}/error0/6-13-job ] || [ ! -f ${PLAYGROUND}/error1/6-13-job ]; then
+    echo "The inputs were not moved to their error paths"
+    exit 1
+fi
+
+if [ -n "$(find ${PLAYGROUND}/input0 ${PLAYGROUND}/input1 ${PLAYGROUND}/output -type f)" ]; then
+    echo "Some files were left behind"
+    exit 1
+fi
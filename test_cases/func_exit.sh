@@ -0,0 +1,52 @@
+#!/usr/bin/env bash
+# --exit maps exit codes and signals to outcomes: 'retry' leaves the input in
+# place and records the attempt, 'skip' removes the input without any output
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+reset() {
+    rm -rf ${PLAYGROUND}/input
+    rm -rf ${PLAYGROUND}/output
+    rm -rf ${PLAYGROUND}/error
+
+    mkdir -p ${PLAYGROUND}/input
+    mkdir -p ${PLAYGROUND}/output
+    mkdir -p ${PLAYGROUND}/error
+
+    echo data > ${PLAYGROUND}/input/job
+}
+
+# retry
+reset
+timeout 20 pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'cat; exit 75' --output=${PLAYGROUND}/output/ \
+     --error=${PLAYGROUND}/error/ --exit=75:retry &> ${PLAYGROUND}/pmjq.log
+
+if [ ! -f ${PLAYGROUND}/input/job ] || [ -n "$(find ${PLAYGROUND}/output ${PLAYGROUND}/error -type f)" ]; then
+    echo "The input of the job to retry was not left in place, alone"
+    exit 1
+fi
+test "$(cut -d' ' -f1 ${PLAYGROUND}/input/.pmjq-attempts-job)" = 1
+
+# skip
+reset
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'cat; exit 3' --output=${PLAYGROUND}/output/ \
+     --error=${PLAYGROUND}/error/ --exit=3:skip &>> ${PLAYGROUND}/pmjq.log
+
+if [ -n "$(find ${PLAYGROUND}/input ${PLAYGROUND}/output ${PLAYGROUND}/error -type f)" ]; then
+    echo "The input of the skipped job was not removed, or an output or error file was written"
+    exit 1
+fi
+
+# A signal
+reset
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'cat; kill -TERM $$' --output=${PLAYGROUND}/output/ \
+     --error=${PLAYGROUND}/error/ --exit=SIGTERM:skip &>> ${PLAYGROUND}/pmjq.log
+
+if [ -n "$(find ${PLAYGROUND}/input ${PLAYGROUND}/output ${PLAYGROUND}/error -type f)" ]; then
+    echo "The signal was not mapped to 'skip'"
+    exit 1
+fi
@@ -0,0 +1,58 @@
+#!/usr/bin/env bash
+# The on-success and on-failure hooks are given the paths of the files as they
+# are once the job is done, a veto of the pre-run hook is only tried again
+# after --retry-delay, and --hook-timeout kills a hook that runs for too long
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+reset() {
+    rm -rf ${PLAYGROUND}/input
+    rm -rf ${PLAYGROUND}/output
+    rm -rf ${PLAYGROUND}/error
+    rm -f ${PLAYGROUND}/hook.txt
+
+    mkdir -p ${PLAYGROUND}/input
+    mkdir -p ${PLAYGROUND}/output
+    mkdir -p ${PLAYGROUND}/error
+}
+
+# on-success and on-failure
+reset
+echo OK > ${PLAYGROUND}/input/OK.txt
+echo error > ${PLAYGROUND}/input/error.txt
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'grep -v error' --output=${PLAYGROUND}/output/ \
+     --error=${PLAYGROUND}/error/ --on-success='test -f "$1" && echo "success $1" >> '${PLAYGROUND}/hook.txt \
+     --on-failure='test -f "$1" && echo "failure $1" >> '${PLAYGROUND}/hook.txt &> ${PLAYGROUND}/pmjq.log
+
+grep -x "success ${PLAYGROUND}/output/OK.txt" ${PLAYGROUND}/hook.txt
+grep -x "failure ${PLAYGROUND}/error/error.txt" ${PLAYGROUND}/hook.txt
+
+# A veto is not tried again before --retry-delay
+reset
+echo OK > ${PLAYGROUND}/input/OK.txt
+
+set +e
+timeout 8 pmjq --input=${PLAYGROUND}/input/'.*' cat --output=${PLAYGROUND}/output/ \
+     --pre-run="sh -c 'echo veto >> ${PLAYGROUND}/hook.txt; false'" --retry-delay=1h &>> ${PLAYGROUND}/pmjq.log
+test $? -eq 124
+set -e
+
+test "$(wc -l < ${PLAYGROUND}/hook.txt)" = 1
+test -f ${PLAYGROUND}/input/OK.txt
+test -f ${PLAYGROUND}/input/.pmjq-attempts-OK.txt
+
+# A hook that runs for too long is killed, which vetoes the job
+reset
+echo OK > ${PLAYGROUND}/input/OK.txt
+
+timeout 20 pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' cat --output=${PLAYGROUND}/output/ \
+     --pre-run='sleep 100' --hook-timeout=1s &>> ${PLAYGROUND}/pmjq.log
+
+grep "still running after 1s, killing it" ${PLAYGROUND}/pmjq.log
+test -f ${PLAYGROUND}/input/OK.txt
+test ! -e ${PLAYGROUND}/output/OK.txt
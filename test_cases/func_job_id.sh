@@ -0,0 +1,39 @@
+#!/usr/bin/env bash
+# {{.JobID}} is unique, even among the jobs found by different listings of the
+# input dir
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+
+wait_for_outputs() {
+    for i in $(seq 50); do
+        if [ "$(ls ${PLAYGROUND}/output | wc -l)" -ge "$1" ]; then
+            return
+        fi
+        sleep 0.2
+    done
+    echo "The outputs did not show up"
+    exit 1
+}
+
+pmjq --input=${PLAYGROUND}/input/'.*' cat --output=${PLAYGROUND}/output/'{{.JobID}}' &> ${PLAYGROUND}/pmjq.log &
+PMJQ=$!
+trap "kill ${PMJQ}" EXIT
+
+echo a > ${PLAYGROUND}/input/a
+wait_for_outputs 1
+echo b > ${PLAYGROUND}/input/b
+wait_for_outputs 2
+echo c > ${PLAYGROUND}/input/c
+wait_for_outputs 3
+
+test "$(ls ${PLAYGROUND}/output | wc -l)" = 3
@@ -0,0 +1,51 @@
+#!/usr/bin/env bash
+# --on-existing: skip the job or suffix the output when it already exists, and
+# an output that existed before a failed job is left untouched
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+reset() {
+    rm -rf ${PLAYGROUND}/input
+    rm -rf ${PLAYGROUND}/output
+    rm -rf ${PLAYGROUND}/error
+
+    mkdir -p ${PLAYGROUND}/input
+    mkdir -p ${PLAYGROUND}/output
+    mkdir -p ${PLAYGROUND}/error
+
+    echo new > ${PLAYGROUND}/input/a.txt
+    echo old > ${PLAYGROUND}/output/a.txt
+}
+
+# skip
+reset
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' cat --output=${PLAYGROUND}/output/ --on-existing=skip &> ${PLAYGROUND}/pmjq.log
+
+grep -x old ${PLAYGROUND}/output/a.txt
+if [ -n "$(ls ${PLAYGROUND}/input)" ]; then
+    echo "The input of the skipped job was not removed"
+    exit 1
+fi
+
+# suffix
+reset
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' cat --output=${PLAYGROUND}/output/ --on-existing=suffix &>> ${PLAYGROUND}/pmjq.log
+
+grep -x old ${PLAYGROUND}/output/a.txt
+grep -x new ${PLAYGROUND}/output/a.1.txt
+
+# A failed job does not remove an output that existed before it
+reset
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'echo partial; false' --output=${PLAYGROUND}/output/ \
+     --error=${PLAYGROUND}/error/ &>> ${PLAYGROUND}/pmjq.log
+
+grep -x old ${PLAYGROUND}/output/a.txt
+test -f ${PLAYGROUND}/error/a.txt
+if [ -n "$(find ${PLAYGROUND}/output -name '.pmjq-*')" ]; then
+    echo "A staging file was left behind"
+    exit 1
+fi
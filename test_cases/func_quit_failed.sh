@@ -0,0 +1,24 @@
+#!/usr/bin/env bash
+# Without --error, the inputs of a failed job are left in place, which must not
+# keep --quit-when-empty from exiting once they have had their last attempt
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+
+echo error > ${PLAYGROUND}/input/error.txt
+
+timeout 20 pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' false --output=${PLAYGROUND}/output/ &> ${PLAYGROUND}/pmjq.log
+
+if [ ! -f ${PLAYGROUND}/input/error.txt ] || [ -e ${PLAYGROUND}/output/error.txt ]; then
+    echo "The input of the failed job was not left in place"
+    exit 1
+fi
@@ -0,0 +1,48 @@
+#!/usr/bin/env bash
+# The number of attempts is kept in a sidecar file next to the input, so that
+# it survives a restart, and the log of each attempt is kept
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+rm -rf ${PLAYGROUND}/error
+rm -rf ${PLAYGROUND}/log
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+mkdir -p ${PLAYGROUND}/error
+mkdir -p ${PLAYGROUND}/log
+
+echo data > ${PLAYGROUND}/input/job
+
+# First attempt, then a restart before the second one is due
+set +e
+timeout 2 pmjq --input=${PLAYGROUND}/input/'.*' --shell 'echo failing >&2; false' --output=${PLAYGROUND}/output/ \
+     --stderr=${PLAYGROUND}/log/ --error=${PLAYGROUND}/error/ --retries=2 --retry-delay=1h &> ${PLAYGROUND}/pmjq.log
+test $? -eq 124
+set -e
+
+if [ "$(cut -d' ' -f1 ${PLAYGROUND}/input/.pmjq-attempts-job)" != 1 ] || [ ! -f ${PLAYGROUND}/log/job ]; then
+    echo "The first attempt was not recorded"
+    exit 1
+fi
+
+# Make the second attempt due, the third one is due 2s after it
+echo "1 0" > ${PLAYGROUND}/input/.pmjq-attempts-job
+timeout 30 pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'echo failing >&2; false' --output=${PLAYGROUND}/output/ \
+     --stderr=${PLAYGROUND}/log/ --error=${PLAYGROUND}/error/ --retries=2 --retry-delay=1s &>> ${PLAYGROUND}/pmjq.log
+
+if [ ! -f ${PLAYGROUND}/log/job.2 ] || [ ! -f ${PLAYGROUND}/log/job.3 ] || [ -f ${PLAYGROUND}/log/job.4 ]; then
+    echo "The log of each attempt was not kept"
+    exit 1
+fi
+
+if [ ! -f ${PLAYGROUND}/error/job ] || [ -n "$(ls -A ${PLAYGROUND}/input)" ]; then
+    echo "The input was not rejected after the last attempt, or its attempts file was left behind"
+    exit 1
+fi
@@ -0,0 +1,45 @@
+#!/usr/bin/env bash
+# With --shell, the command can be a pipeline. The file names must only be
+# reached through the positional parameters, never pasted in the shell's source
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+
+echo hello > ${PLAYGROUND}/input/'$(touch pwned).txt'
+
+cd "$(dirname "$0")"
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/ 'test -f "$1" && tr a-z A-Z | rev' --output=${PLAYGROUND}/output/ --shell &> ${PLAYGROUND}/pmjq.log
+
+grep -x OLLEH ${PLAYGROUND}/output/'$(touch pwned).txt'
+
+if [ -e pwned ]; then
+    echo "A file name was interpreted by the shell"
+    exit 1
+fi
+
+if [ -f ${PLAYGROUND}/input/* ]; then
+    echo "Not all files in the input dir have been processed"
+    exit 1
+fi
+
+# A name pasted in the shell's source through shellquote is read as one word,
+# the same as the positional parameter
+echo hello > ${PLAYGROUND}/input/"it's \"\$(touch pwned)\".txt"
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/ 'test "$1" = {{.InputPath 0 | shellquote}} && cat {{.InputPath 0 | shellquote}}' --output=${PLAYGROUND}/output/ --shell &> ${PLAYGROUND}/pmjq.log
+
+grep -x hello ${PLAYGROUND}/output/"it's \"\$(touch pwned)\".txt"
+
+if [ -e pwned ]; then
+    echo "A quoted file name was interpreted by the shell"
+    exit 1
+fi
@@ -0,0 +1,38 @@
+#!/usr/bin/env bash
+# --stdin chooses what cmd reads when there are several inputs: one of them,
+# by number or by directory name, all of them concatenated, or framed by their
+# sizes
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+run() {
+    rm -rf ${PLAYGROUND}/input0
+    rm -rf ${PLAYGROUND}/input1
+    rm -rf ${PLAYGROUND}/output
+
+    mkdir -p ${PLAYGROUND}/input0
+    mkdir -p ${PLAYGROUND}/input1
+    mkdir -p ${PLAYGROUND}/output
+
+    echo first > ${PLAYGROUND}/input0/job
+    printf 'second\ninput' > ${PLAYGROUND}/input1/job
+
+    pmjq --quit-when-empty --input=${PLAYGROUND}/input0/'.*' --input=${PLAYGROUND}/input1/'.*' --invariant='$0' \
+         cat --output=${PLAYGROUND}/output/'{{.Invariant}}' --stdin="$1" &>> ${PLAYGROUND}/pmjq.log
+
+    printf "$2" > ${PLAYGROUND}/expected
+    if ! cmp ${PLAYGROUND}/expected ${PLAYGROUND}/output/job; then
+        echo "--stdin=$1 did not feed the expected bytes"
+        exit 1
+    fi
+}
+
+rm -f ${PLAYGROUND}/pmjq.log
+run concat 'first\nsecond\ninput'
+run framed '6\nfirst\n12\nsecond\ninput'
+run input1 'second\ninput'
+run 0 'first\n'
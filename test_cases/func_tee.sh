@@ -0,0 +1,33 @@
+#!/usr/bin/env bash
+# --tee writes stdout to the chosen outputs, which are hard links to one another
+# when they are on the same filesystem
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output0
+rm -rf ${PLAYGROUND}/output1
+rm -rf ${PLAYGROUND}/output2
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output0
+mkdir -p ${PLAYGROUND}/output1
+mkdir -p ${PLAYGROUND}/output2
+
+echo hello > ${PLAYGROUND}/input/a
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' 'tr a-z A-Z' --output=${PLAYGROUND}/output0/'{{.Input 0}}' \
+     --output=${PLAYGROUND}/output1/'{{.Input 0}}' --output=${PLAYGROUND}/output2/'{{.Input 0}}' --tee=0,2 &> ${PLAYGROUND}/pmjq.log
+
+grep -x HELLO ${PLAYGROUND}/output0/a
+cmp ${PLAYGROUND}/output0/a ${PLAYGROUND}/output2/a
+test "$(stat -c %i ${PLAYGROUND}/output0/a)" = "$(stat -c %i ${PLAYGROUND}/output2/a)"
+
+if [ -e ${PLAYGROUND}/output1/a ]; then
+    echo "An output that is not in --tee was written"
+    exit 1
+fi
@@ -0,0 +1,31 @@
+#!/usr/bin/env bash
+# The template functions: shellquote, stripext, upper and ulid
+set -e
+set -u
+set -x
+set -o pipefail
+
+PLAYGROUND=/tmp
+
+rm -rf ${PLAYGROUND}/input
+rm -rf ${PLAYGROUND}/output
+
+mkdir -p ${PLAYGROUND}/input
+mkdir -p ${PLAYGROUND}/output
+
+echo OK > "${PLAYGROUND}/input/it's a.txt"
+
+pmjq --quit-when-empty --input=${PLAYGROUND}/input/'.*' --shell 'echo {{.Input 0 | shellquote}}; echo {{ulid}}' \
+     --output=${PLAYGROUND}/output/'{{.Input 0 | stripext | upper}}' &> ${PLAYGROUND}/pmjq.log
+
+if [ ! -f "${PLAYGROUND}/output/IT'S A" ]; then
+    echo "stripext and upper did not work"
+    exit 1
+fi
+
+if [ "$(sed -n 1p "${PLAYGROUND}/output/IT'S A")" != "it's a.txt" ]; then
+    echo "shellquote did not quote the name"
+    exit 1
+fi
+
+sed -n 2p "${PLAYGROUND}/output/IT'S A" | grep -xE '[0-9A-HJKMNP-TV-Z]{26}'